@@ -20,14 +20,30 @@ type FaceitClient struct {
 
 // PlayerInfo contains information about a player
 type PlayerInfo struct {
-	SteamID     string
-	Nickname    string
-	AudioFile   string
-	AudioLength string // Duration like "1m 23s" or "45s"
-	FaceitLevel int
-	FaceitElo   int
-	DemoID      string // Track which demo the voice belongs to
-	Team        string // Team 1 or Team 2
+	SteamID      string
+	Nickname     string
+	AudioFile    string
+	AudioLength  string // Duration like "1m 23s" or "45s"
+	FaceitLevel  int
+	FaceitElo    int
+	DemoID       string // Track which demo the voice belongs to
+	Team         string // Team 1 or Team 2
+	DecodeErrors int    // Voice packets that could not be decoded
+	// Steam voice frames lost in transit that were rebuilt from FEC data or
+	// concealed with PLC
+	RecoveredFrames int
+	ConcealedFrames int
+}
+
+// HTTPStatusError is returned when a Faceit endpoint answers with an
+// unexpected status, so callers can tell e.g. a 403 from a network error
+type HTTPStatusError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *HTTPStatusError) Error() string {
+	return fmt.Sprintf("HTTP %d: %s", e.StatusCode, e.Body)
 }
 
 // FaceitResponse represents the response from the Faceit API
@@ -475,7 +491,7 @@ func (c *FaceitClient) GetSignedDemoURL(resourceURL string) (string, error) {
 	if resp.StatusCode != http.StatusOK {
 		bodyBytes, _ := io.ReadAll(resp.Body)
 		fmt.Printf("🔍 DEBUG [GetSignedDemoURL]: Error response: %s\n", string(bodyBytes))
-		return "", fmt.Errorf("download API returned status %d: %s", resp.StatusCode, string(bodyBytes))
+		return "", fmt.Errorf("download API returned %w", &HTTPStatusError{StatusCode: resp.StatusCode, Body: string(bodyBytes)})
 	}
 
 	var downloadResp DemoDownloadResponse
@@ -542,7 +558,7 @@ func (c *FaceitClient) downloadToFile(url, savePath string) (int64, error) {
 
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
-		return 0, fmt.Errorf("HTTP %d: %s", resp.StatusCode, string(body))
+		return 0, &HTTPStatusError{StatusCode: resp.StatusCode, Body: string(body)}
 	}
 
 	if resp.ContentLength > 0 {
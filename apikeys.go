@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"demovoice/storage"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	apiKeys *storage.APIKeyStore                              // Registered API clients
+	usage   storage.UsageCounter = storage.NewMemoryCounter() // Rate limit, quota and usage counters; Redis when configured
+)
+
+// errQuotaExceeded is returned when a key has used up its daily demo quota
+var errQuotaExceeded = errors.New("daily processing quota exceeded")
+
+// envAPIKey stands in for the legacy API_KEY environment variable, which
+// keeps working as an unlimited admin key
+var envAPIKey = &storage.APIKey{ID: "env", Name: "API_KEY", Scopes: []string{storage.ScopeAdmin}}
+
+// apiAuthError is why a request was not allowed, with the response to send
+type apiAuthError struct {
+	Status     int
+	Code       string // "unauthorized", "forbidden" or "rate_limited"
+	Message    string
+	RetryAfter time.Duration
+}
+
+type apiKeyContextKey struct{}
+
+// APIKeyUsage are the usage counters of a key
+type APIKeyUsage struct {
+	RequestsTotal      int64 `json:"requests_total"`
+	RequestsThisMinute int64 `json:"requests_this_minute"`
+	DemosToday         int64 `json:"demos_today"`
+	DemosTotal         int64 `json:"demos_total"`
+}
+
+// APIKeyResource is an API key as returned by the key management endpoints
+type APIKeyResource struct {
+	Key    storage.APIKey `json:"key"`
+	Usage  APIKeyUsage    `json:"usage"`
+	Secret string         `json:"secret,omitempty"` // Only returned when the key is created
+}
+
+// APIKeyList is the response of GET /api/v1/keys
+type APIKeyList struct {
+	Keys []APIKeyResource `json:"keys"`
+}
+
+// createAPIKeyRequest is the JSON body of POST /api/v1/keys
+type createAPIKeyRequest struct {
+	Name       string   `json:"name"`
+	Scopes     []string `json:"scopes"`
+	RateLimit  int      `json:"rate_limit"`  // Requests per minute, 0 for unlimited
+	DailyQuota int      `json:"daily_quota"` // Demos per UTC day, 0 for unlimited
+}
+
+// requestAPIKey returns the secret sent as X-API-Key or as a bearer token
+func requestAPIKey(r *http.Request) string {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return key
+	}
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return token
+	}
+	return ""
+}
+
+// authenticateAPIKey finds the key of a request and checks its scope and
+// rate limit; an empty scope accepts any key. Without any configured keys the
+// API is open and the key is nil.
+func authenticateAPIKey(r *http.Request, scope string) (*storage.APIKey, *apiAuthError) {
+	secret := requestAPIKey(r)
+	envKey := os.Getenv("API_KEY")
+
+	var key *storage.APIKey
+	switch {
+	case secret != "" && envKey != "" && hmac.Equal([]byte(secret), []byte(envKey)):
+		key = envAPIKey
+	case secret != "":
+		found, err := apiKeys.Lookup(secret)
+		if err != nil {
+			return nil, &apiAuthError{Status: http.StatusUnauthorized, Code: "unauthorized", Message: "Invalid API key"}
+		}
+		key = found
+	case envKey == "" && apiKeys.Len() == 0:
+		return nil, nil
+	default:
+		return nil, &apiAuthError{Status: http.StatusUnauthorized, Code: "unauthorized", Message: "Missing API key"}
+	}
+
+	if scope != "" && !key.HasScope(scope) {
+		return nil, &apiAuthError{Status: http.StatusForbidden, Code: "forbidden", Message: fmt.Sprintf("API key %q lacks the %s scope", key.Name, scope)}
+	}
+
+	if key.RateLimit > 0 && !isOwnUploadChunk(r, key) {
+		now := time.Now()
+		window := strconv.FormatInt(now.Unix()/60, 10)
+		count, err := usage.IncrCounter(key.ID+":rate:"+window, 1, 2*time.Minute)
+		if err != nil {
+			log.Printf("Warning: Failed to count request for API key %s: %v", key.ID, err)
+		} else if count > int64(key.RateLimit) {
+			return nil, &apiAuthError{
+				Status:     http.StatusTooManyRequests,
+				Code:       "rate_limited",
+				Message:    fmt.Sprintf("Rate limit of %d requests per minute exceeded", key.RateLimit),
+				RetryAfter: now.Truncate(time.Minute).Add(time.Minute).Sub(now),
+			}
+		}
+	}
+	usage.IncrCounter(key.ID+":requests", 1, 0)
+
+	return key, nil
+}
+
+// isOwnUploadChunk reports whether a request sends a chunk of a resumable
+// upload that key started. Chunks don't count against the rate limit, so a
+// large upload can't use up its key's requests; starting it already counted.
+func isOwnUploadChunk(r *http.Request, key *storage.APIKey) bool {
+	if r.Method != http.MethodPatch || !strings.HasPrefix(r.URL.Path, "/api/v1/uploads/") || uploadStore == nil {
+		return false
+	}
+	upload, err := uploadStore.Load(r.PathValue("id"))
+	return err == nil && upload.KeyID == key.ID
+}
+
+// authorizeAPIRequest authenticates a request to the older JSON endpoints,
+// writing an APIUploadResponse error when it is not allowed
+func authorizeAPIRequest(w http.ResponseWriter, r *http.Request, scope string) (*storage.APIKey, bool) {
+	key, authErr := authenticateAPIKey(r, scope)
+	if authErr != nil {
+		log.Printf("⚠️  API request to %s rejected: %s", r.URL.Path, authErr.Message)
+		if authErr.RetryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(authErr.RetryAfter.Seconds())+1))
+		}
+		writeJSONError(w, authErr.Status, authErr.Message)
+		return nil, false
+	}
+	return key, true
+}
+
+// apiKeyFromContext returns the key a /api/v1 request was authenticated with
+func apiKeyFromContext(r *http.Request) *storage.APIKey {
+	key, _ := r.Context().Value(apiKeyContextKey{}).(*storage.APIKey)
+	return key
+}
+
+// dailyQuotaKey is the counter of demos a key has processed today
+func dailyQuotaKey(key *storage.APIKey) string {
+	return key.ID + ":demos:" + time.Now().UTC().Format("2006-01-02")
+}
+
+// chargeDemoQuota counts a demo against a key's daily quota
+func chargeDemoQuota(key *storage.APIKey) error {
+	if key == nil {
+		return nil
+	}
+
+	count, err := usage.IncrCounter(dailyQuotaKey(key), 1, 48*time.Hour)
+	if err != nil {
+		log.Printf("Warning: Failed to count demo for API key %s: %v", key.ID, err)
+		return nil
+	}
+	if key.DailyQuota > 0 && count > int64(key.DailyQuota) {
+		usage.IncrCounter(dailyQuotaKey(key), -1, 48*time.Hour)
+		return errQuotaExceeded
+	}
+
+	usage.IncrCounter(key.ID+":demos", 1, 0)
+	return nil
+}
+
+// quotaExhausted reports whether a key has no demos left today
+func quotaExhausted(key *storage.APIKey) bool {
+	if key == nil || key.DailyQuota <= 0 {
+		return false
+	}
+	count, _ := usage.GetCounter(dailyQuotaKey(key))
+	return count >= int64(key.DailyQuota)
+}
+
+// refundDemoQuota gives back a charged demo that could not be queued
+func refundDemoQuota(key *storage.APIKey) {
+	if key == nil {
+		return
+	}
+	usage.IncrCounter(dailyQuotaKey(key), -1, 48*time.Hour)
+	usage.IncrCounter(key.ID+":demos", -1, 0)
+}
+
+// apiKeyUsage reads the usage counters of a key
+func apiKeyUsage(key *storage.APIKey) APIKeyUsage {
+	var u APIKeyUsage
+	u.RequestsTotal, _ = usage.GetCounter(key.ID + ":requests")
+	u.RequestsThisMinute, _ = usage.GetCounter(key.ID + ":rate:" + strconv.FormatInt(time.Now().Unix()/60, 10))
+	u.DemosToday, _ = usage.GetCounter(dailyQuotaKey(key))
+	u.DemosTotal, _ = usage.GetCounter(key.ID + ":demos")
+	return u
+}
+
+func newAPIKeyResource(key *storage.APIKey) APIKeyResource {
+	resource := APIKeyResource{Key: *key, Usage: apiKeyUsage(key)}
+	resource.Key.Hash = ""
+	return resource
+}
+
+// requireAdminKey rejects key management in open mode, where requests carry no key
+func requireAdminKey(w http.ResponseWriter, r *http.Request) bool {
+	if apiKeyFromContext(r) == nil {
+		writeAPIError(w, http.StatusUnauthorized, "unauthorized", "Managing API keys requires an admin key")
+		return false
+	}
+	return true
+}
+
+// handleListAPIKeys lists every key with its usage
+func handleListAPIKeys(w http.ResponseWriter, r *http.Request) {
+	if !requireAdminKey(w, r) {
+		return
+	}
+
+	list := APIKeyList{Keys: []APIKeyResource{}}
+	for _, key := range apiKeys.List() {
+		list.Keys = append(list.Keys, newAPIKeyResource(&key))
+	}
+	writeAPIJSON(w, http.StatusOK, list)
+}
+
+// handleCreateAPIKey registers a key and returns its secret once
+func handleCreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	if !requireAdminKey(w, r) {
+		return
+	}
+
+	var body createAPIKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "bad_request", "Invalid JSON body: "+err.Error())
+		return
+	}
+
+	key, secret, err := apiKeys.Create(body.Name, body.Scopes, body.RateLimit, body.DailyQuota)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "bad_request", err.Error())
+		return
+	}
+
+	log.Printf("🔑 Created API key %s (%s) with scopes %v", key.ID, key.Name, key.Scopes)
+
+	resource := newAPIKeyResource(key)
+	resource.Secret = secret
+	writeAPIJSON(w, http.StatusCreated, resource)
+}
+
+// handleGetAPIKey returns a single key with its usage
+func handleGetAPIKey(w http.ResponseWriter, r *http.Request) {
+	if !requireAdminKey(w, r) {
+		return
+	}
+
+	key, err := apiKeys.Get(r.PathValue("id"))
+	if err != nil {
+		writeAPIError(w, http.StatusNotFound, "not_found", "API key not found")
+		return
+	}
+	writeAPIJSON(w, http.StatusOK, newAPIKeyResource(key))
+}
+
+// handleRevokeAPIKey revokes a key; requests using it are rejected immediately
+func handleRevokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	if !requireAdminKey(w, r) {
+		return
+	}
+
+	key, err := apiKeys.Revoke(r.PathValue("id"))
+	if errors.Is(err, storage.ErrAPIKeyNotFound) {
+		writeAPIError(w, http.StatusNotFound, "not_found", "API key not found")
+		return
+	}
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "internal_error", "Failed to revoke API key")
+		return
+	}
+
+	log.Printf("🔑 Revoked API key %s (%s)", key.ID, key.Name)
+	writeAPIJSON(w, http.StatusOK, newAPIKeyResource(key))
+}
+
+// handleCurrentAPIKey returns the key the request was made with, so clients
+// can check their own limits and usage
+func handleCurrentAPIKey(w http.ResponseWriter, r *http.Request) {
+	key := apiKeyFromContext(r)
+	if key == nil {
+		writeAPIError(w, http.StatusUnauthorized, "unauthorized", "No API key was sent")
+		return
+	}
+	writeAPIJSON(w, http.StatusOK, newAPIKeyResource(key))
+}
+
+// withAPIKey stores the authenticated key in the request context
+func withAPIKey(r *http.Request, key *storage.APIKey) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), apiKeyContextKey{}, key))
+}
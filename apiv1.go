@@ -0,0 +1,491 @@
+package main
+
+import (
+	"demovoice/api"
+	"demovoice/storage"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Pagination limits for GET /api/v1/demos
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+)
+
+// APIError is the error envelope returned by every /api/v1 endpoint
+type APIError struct {
+	Error APIErrorDetail `json:"error"`
+}
+
+// APIErrorDetail describes a failed request with a machine-readable code
+type APIErrorDetail struct {
+	Code    string `json:"code"` // "bad_request", "unauthorized", "forbidden", "rate_limited", "quota_exceeded", "not_found", "conflict", "queue_full", "internal_error"
+	Message string `json:"message"`
+}
+
+// DemoResource is a demo as returned by /api/v1
+type DemoResource struct {
+	ID            string                   `json:"id"`
+	Filename      string                   `json:"filename"`
+	Status        string                   `json:"status"`
+	QueuePosition int                      `json:"queue_position,omitempty"`
+	MatchID       string                   `json:"match_id,omitempty"`
+	Map           string                   `json:"map,omitempty"`
+	UploadTime    time.Time                `json:"upload_time"`
+	Version       int                      `json:"version,omitempty"`
+	PlayerCount   int                      `json:"player_count"`
+	Files         DemoFiles                `json:"files"`
+	Rounds        []storage.RoundInfo      `json:"rounds,omitempty"`
+	Runs          []storage.ProcessingRun  `json:"runs,omitempty"`
+	Error         *storage.ProcessingError `json:"error,omitempty"`
+	Warnings      []string                 `json:"warnings,omitempty"`
+	URLs          map[string]string        `json:"urls,omitempty"`         // Signed download URLs of every output file, by filename
+	AccessToken   string                   `json:"access_token,omitempty"` // Returned when creating a demo; grants read access without a key
+}
+
+// DemoFiles are signed download URLs of the per-demo outputs
+type DemoFiles struct {
+	ChatLog      string `json:"chat_log,omitempty"`
+	ChatLogJSON  string `json:"chat_log_json,omitempty"`
+	Segments     string `json:"segments,omitempty"`
+	Mixdown      string `json:"mixdown,omitempty"`
+	SubtitlesVTT string `json:"subtitles_vtt,omitempty"`
+	SubtitlesSRT string `json:"subtitles_srt,omitempty"`
+}
+
+// DemoList is a page of demos, newest first
+type DemoList struct {
+	Demos   []DemoResource `json:"demos"`
+	Page    int            `json:"page"`
+	PerPage int            `json:"per_page"`
+	Total   int            `json:"total"`
+}
+
+// PlayerList is the players of a demo with their audio tracks
+type PlayerList struct {
+	DemoID    string            `json:"demo_id"`
+	Players   []api.PlayerInfo  `json:"players"`
+	AudioURLs map[string]string `json:"audio_urls,omitempty"` // SteamID64 -> signed download URL
+}
+
+// ChatLog is the structured chat of a demo
+type ChatLog struct {
+	DemoID   string                `json:"demo_id"`
+	Messages []storage.ChatMessage `json:"messages"`
+}
+
+// createDemoRequest is the JSON body of POST /api/v1/demos for match downloads
+type createDemoRequest struct {
+	MatchURL string `json:"match_url"`
+}
+
+// registerAPIv1Routes adds the versioned REST API to the default mux
+func registerAPIv1Routes() {
+	http.HandleFunc("OPTIONS /api/v1/", handleAPIv1Preflight)
+	http.HandleFunc("GET /api/v1/demos", apiV1(storage.ScopeRead, handleListDemos))
+	http.HandleFunc("POST /api/v1/demos", apiV1(storage.ScopeUpload, handleCreateDemo))
+	http.HandleFunc("GET /api/v1/demos/{id}", apiV1(storage.ScopeRead, handleGetDemo))
+	http.HandleFunc("DELETE /api/v1/demos/{id}", apiV1(storage.ScopeDelete, handleDeleteDemo))
+	http.HandleFunc("GET /api/v1/demos/{id}/players", apiV1(storage.ScopeRead, handleGetDemoPlayers))
+	http.HandleFunc("GET /api/v1/demos/{id}/chat", apiV1(storage.ScopeRead, handleGetDemoChat))
+}
+
+// registerAPIKeyRoutes adds the API key management endpoints
+func registerAPIKeyRoutes() {
+	http.HandleFunc("GET /api/v1/keys", apiV1(storage.ScopeAdmin, handleListAPIKeys))
+	http.HandleFunc("POST /api/v1/keys", apiV1(storage.ScopeAdmin, handleCreateAPIKey))
+	http.HandleFunc("GET /api/v1/keys/me", apiV1("", handleCurrentAPIKey))
+	http.HandleFunc("GET /api/v1/keys/{id}", apiV1(storage.ScopeAdmin, handleGetAPIKey))
+	http.HandleFunc("DELETE /api/v1/keys/{id}", apiV1(storage.ScopeAdmin, handleRevokeAPIKey))
+}
+
+// registerResumableUploadRoutes adds the tus endpoints for chunked uploads
+func registerResumableUploadRoutes() {
+	http.HandleFunc("OPTIONS /api/v1/uploads", handleTusOptions)
+	http.HandleFunc("POST /api/v1/uploads", apiV1(storage.ScopeUpload, handleCreateUpload))
+	http.HandleFunc("GET /api/v1/uploads/{id}", apiV1(storage.ScopeUpload, handleGetUpload))
+	http.HandleFunc("PATCH /api/v1/uploads/{id}", apiV1(storage.ScopeUpload, handlePatchUpload))
+	http.HandleFunc("DELETE /api/v1/uploads/{id}", apiV1(storage.ScopeUpload, handleDeleteUpload))
+}
+
+// apiV1 adds CORS headers and API key checks to a /api/v1 handler. The key
+// is available to the handler through apiKeyFromContext.
+func apiV1(scope string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		setAPIv1CORSHeaders(w)
+		key, authErr := authenticateAPIKey(r, scope)
+		if authErr != nil {
+			log.Printf("⚠️  API request to %s rejected: %s", r.URL.Path, authErr.Message)
+			if authErr.RetryAfter > 0 {
+				w.Header().Set("Retry-After", strconv.Itoa(int(authErr.RetryAfter.Seconds())+1))
+			}
+			writeAPIError(w, authErr.Status, authErr.Code, authErr.Message)
+			return
+		}
+		h(w, withAPIKey(r, key))
+	}
+}
+
+func setAPIv1CORSHeaders(w http.ResponseWriter) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, POST, PATCH, DELETE, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-API-Key, Tus-Resumable, Upload-Length, Upload-Offset, Upload-Metadata")
+	w.Header().Set("Access-Control-Expose-Headers", "Location, Retry-After, Tus-Resumable, Tus-Version, Tus-Extension, Upload-Offset, Upload-Length, Upload-Expires, X-Demo-ID")
+}
+
+func handleAPIv1Preflight(w http.ResponseWriter, r *http.Request) {
+	setAPIv1CORSHeaders(w)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writeAPIJSON writes a /api/v1 response body
+func writeAPIJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeAPIError writes the /api/v1 error envelope
+func writeAPIError(w http.ResponseWriter, status int, code, message string) {
+	writeAPIJSON(w, status, APIError{Error: APIErrorDetail{Code: code, Message: message}})
+}
+
+// newDemoResource converts stored metadata to its API representation. Download
+// URLs are only included when signed is set.
+func newDemoResource(metadata *storage.DemoMetadata, signed bool) DemoResource {
+	resource := DemoResource{
+		ID:          metadata.DemoID,
+		Filename:    metadata.Filename,
+		Status:      metadata.Status,
+		MatchID:     metadata.MatchID,
+		Map:         metadata.Map,
+		UploadTime:  metadata.UploadTime,
+		Version:     metadata.Version,
+		PlayerCount: len(metadata.Players),
+		Files: DemoFiles{
+			ChatLog:      signedOutputURL(metadata.ChatLog),
+			ChatLogJSON:  signedOutputURL(metadata.ChatLogJSON),
+			Segments:     signedOutputURL(metadata.Segments),
+			Mixdown:      signedOutputURL(metadata.Mixdown),
+			SubtitlesVTT: signedOutputURL(metadata.SubtitlesVTT),
+			SubtitlesSRT: signedOutputURL(metadata.SubtitlesSRT),
+		},
+		Rounds:   metadata.Rounds,
+		Runs:     metadata.Runs,
+		Error:    metadata.Error,
+		Warnings: metadata.Warnings,
+	}
+	if signed {
+		resource.URLs = outputURLs(metadata)
+	} else {
+		resource.Files = DemoFiles{}
+	}
+	if metadata.Status == "queued" {
+		resource.QueuePosition = jobs.Position(metadata.DemoID)
+	}
+	return resource
+}
+
+// canSignURLs reports whether a /api/v1 caller may be handed signed download
+// URLs of a demo: it authenticated with a key or sent the demo's ?access= token
+func canSignURLs(r *http.Request, demoID string) bool {
+	return apiKeyFromContext(r) != nil || hasDemoAccess(r, demoID)
+}
+
+// createdDemoResource is the response to a request that created or reused a
+// demo. It carries the demo's access token so callers without a key can read
+// it later.
+func createdDemoResource(r *http.Request, metadata *storage.DemoMetadata) DemoResource {
+	resource := newDemoResource(metadata, apiKeyFromContext(r) != nil)
+	resource.AccessToken = demoAccessToken(metadata.DemoID)
+	return resource
+}
+
+// demoInProgress reports whether a demo is still being downloaded or processed
+func demoInProgress(metadata *storage.DemoMetadata) bool {
+	switch metadata.Status {
+	case "downloading", "queued", "processing", "enriching":
+		return true
+	}
+	return false
+}
+
+// loadDemoOr404 loads the demo named in the path, writing a 404 when it does not exist
+func loadDemoOr404(w http.ResponseWriter, r *http.Request) (*storage.DemoMetadata, bool) {
+	metadata, err := metadataStore.LoadMetadata(r.PathValue("id"))
+	if err != nil {
+		writeAPIError(w, http.StatusNotFound, "not_found", "Demo not found")
+		return nil, false
+	}
+	return metadata, true
+}
+
+// pageParam reads a positive integer query parameter
+func pageParam(r *http.Request, name string, def int) (int, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return def, nil
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 1 {
+		return 0, errors.New(name + " must be a positive integer")
+	}
+	return n, nil
+}
+
+// handleListDemos lists demos newest first (?page=, ?per_page=, ?status=).
+// It needs a key even when the API is open, since demos belong to whoever
+// uploaded them.
+func handleListDemos(w http.ResponseWriter, r *http.Request) {
+	if apiKeyFromContext(r) == nil {
+		writeAPIError(w, http.StatusUnauthorized, "unauthorized", "Listing demos requires an API key")
+		return
+	}
+
+	page, err := pageParam(r, "page", 1)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "bad_request", err.Error())
+		return
+	}
+	perPage, err := pageParam(r, "per_page", defaultPageSize)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "bad_request", err.Error())
+		return
+	}
+	perPage = min(perPage, maxPageSize)
+
+	demos, err := metadataStore.ListAllDemos()
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "internal_error", "Failed to list demos")
+		return
+	}
+
+	if status := r.URL.Query().Get("status"); status != "" {
+		filtered := demos[:0]
+		for _, demo := range demos {
+			if demo.Status == status {
+				filtered = append(filtered, demo)
+			}
+		}
+		demos = filtered
+	}
+
+	sort.Slice(demos, func(i, j int) bool {
+		return demos[i].UploadTime.After(demos[j].UploadTime)
+	})
+
+	list := DemoList{Demos: []DemoResource{}, Page: page, PerPage: perPage, Total: len(demos)}
+	start := (page - 1) * perPage
+	for i := start; i < len(demos) && i < start+perPage; i++ {
+		list.Demos = append(list.Demos, newDemoResource(&demos[i], true))
+	}
+
+	writeAPIJSON(w, http.StatusOK, list)
+}
+
+// handleGetDemo returns a single demo
+func handleGetDemo(w http.ResponseWriter, r *http.Request) {
+	metadata, ok := loadDemoOr404(w, r)
+	if !ok {
+		return
+	}
+	writeAPIJSON(w, http.StatusOK, newDemoResource(metadata, canSignURLs(r, metadata.DemoID)))
+}
+
+// handleGetDemoPlayers returns the players of a demo
+func handleGetDemoPlayers(w http.ResponseWriter, r *http.Request) {
+	metadata, ok := loadDemoOr404(w, r)
+	if !ok {
+		return
+	}
+
+	list := PlayerList{DemoID: metadata.DemoID, Players: metadata.Players, AudioURLs: map[string]string{}}
+	if list.Players == nil {
+		list.Players = []api.PlayerInfo{}
+	}
+	signed := canSignURLs(r, metadata.DemoID)
+	for _, player := range list.Players {
+		if signed && player.AudioFile != "" {
+			list.AudioURLs[player.SteamID] = signedOutputURL(player.AudioFile)
+		}
+	}
+	writeAPIJSON(w, http.StatusOK, list)
+}
+
+// handleGetDemoChat returns the structured chat log of a demo
+func handleGetDemoChat(w http.ResponseWriter, r *http.Request) {
+	metadata, ok := loadDemoOr404(w, r)
+	if !ok {
+		return
+	}
+
+	messages := []storage.ChatMessage{}
+	if metadata.ChatLogJSON != "" {
+		loaded, err := metadataStore.LoadChatMessages(metadata.OutputPrefix())
+		if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, "internal_error", "Failed to load chat log")
+			return
+		}
+		messages = append(messages, loaded...)
+	}
+
+	writeAPIJSON(w, http.StatusOK, ChatLog{DemoID: metadata.DemoID, Messages: messages})
+}
+
+// handleDeleteDemo removes a demo with all its outputs and retained source
+func handleDeleteDemo(w http.ResponseWriter, r *http.Request) {
+	metadata, ok := loadDemoOr404(w, r)
+	if !ok {
+		return
+	}
+	if demoInProgress(metadata) {
+		writeAPIError(w, http.StatusConflict, "conflict", "Demo is still being processed")
+		return
+	}
+
+	if err := metadataStore.DeleteDemo(metadata); err != nil {
+		log.Printf("Error deleting demo %s: %v", metadata.DemoID, err)
+		writeAPIError(w, http.StatusInternalServerError, "internal_error", "Failed to delete demo")
+		return
+	}
+	if metadata.Source != "" {
+		os.Remove(filepath.Join(sourceDir, metadata.Source))
+	}
+
+	log.Printf("🗑️  Deleted demo %s", metadata.DemoID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleCreateDemo creates a demo from a multipart upload ("demo" file field)
+// or from a Faceit matchroom URL ("match_url" form field or JSON body).
+// Extraction options are query parameters, as for /api/upload.
+func handleCreateDemo(w http.ResponseWriter, r *http.Request) {
+	opts, err := processOptionsFromRequest(r)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "bad_request", err.Error())
+		return
+	}
+
+	// Reject before receiving the file when there is no room to process it
+	if jobs.Full() {
+		writeAPIError(w, http.StatusServiceUnavailable, ErrCodeQueueFull, ErrQueueFull.Error())
+		return
+	}
+
+	// The file is streamed, so it has to be found before reading form fields
+	var file io.Reader
+	var filename string
+	multipartUpload := strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data")
+	if multipartUpload {
+		file, filename, err = formDemoFile(w, r)
+		if err != nil {
+			status := uploadErrorStatus(err, http.StatusBadRequest)
+			writeAPIError(w, status, uploadErrorCode(status), "Error receiving file: "+err.Error())
+			return
+		}
+	}
+
+	var metadata *storage.DemoMetadata
+	if multipartUpload {
+		// Form fields sent after the file are read once it has been saved
+		path, hash, err := saveDemoUpload(file)
+		if err != nil {
+			status := uploadErrorStatus(err, http.StatusInternalServerError)
+			if status == http.StatusInternalServerError {
+				log.Printf("Error saving upload %s: %v", filename, err)
+				writeAPIError(w, status, "internal_error", "Error saving file")
+				return
+			}
+			writeAPIError(w, status, uploadErrorCode(status), err.Error())
+			return
+		}
+
+		callback, err := webhookTargetFromRequest(r)
+		if err != nil {
+			os.Remove(path)
+			writeAPIError(w, http.StatusBadRequest, "bad_request", err.Error())
+			return
+		}
+		if err := chargeDemoQuota(apiKeyFromContext(r)); err != nil {
+			os.Remove(path)
+			writeAPIError(w, http.StatusTooManyRequests, "quota_exceeded", err.Error())
+			return
+		}
+
+		job := &processingJob{
+			DemoPath:    path,
+			Filename:    filepath.Base(filename),
+			MatchID:     storage.ExtractMatchIDFromFilename(filename),
+			Options:     opts,
+			Callback:    callback,
+			ContentHash: hash,
+		}
+		metadata, _, err = queueStoredDemo(job)
+		if err != nil {
+			refundDemoQuota(apiKeyFromContext(r))
+			writeAPIError(w, http.StatusServiceUnavailable, ErrCodeQueueFull, err.Error())
+			return
+		}
+		if metadata.DemoID != job.DemoID {
+			refundDemoQuota(apiKeyFromContext(r))
+			writeAPIJSON(w, http.StatusOK, createdDemoResource(r, metadata))
+			return
+		}
+	} else {
+		callback, err := webhookTargetFromRequest(r)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, "bad_request", err.Error())
+			return
+		}
+
+		matchURL := r.FormValue("match_url")
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+			var body createDemoRequest
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				writeAPIError(w, http.StatusBadRequest, "bad_request", "Invalid JSON body: "+err.Error())
+				return
+			}
+			matchURL = body.MatchURL
+		}
+		if matchURL == "" {
+			writeAPIError(w, http.StatusBadRequest, "bad_request", "Either a demo file or match_url is required")
+			return
+		}
+
+		matchID := extractMatchIDFromURL(matchURL)
+		if matchID == "" {
+			writeAPIError(w, http.StatusBadRequest, "bad_request", "Invalid matchroom URL format")
+			return
+		}
+
+		if existing, _ := metadataStore.FindDemoByMatchID(matchID, dedupOptions(opts), tempFileLifetime); existing != nil {
+			log.Printf("🎯 API Cache HIT! Reusing existing demo %s for match %s", existing.DemoID, matchID)
+			if callback != nil {
+				notifyWhenFinished(callback, existing)
+			}
+			writeAPIJSON(w, http.StatusOK, createdDemoResource(r, existing))
+			return
+		}
+
+		if err := chargeDemoQuota(apiKeyFromContext(r)); err != nil {
+			writeAPIError(w, http.StatusTooManyRequests, "quota_exceeded", err.Error())
+			return
+		}
+
+		metadata = startDemoDownload(&processingJob{MatchID: matchID, Options: opts, Callback: callback})
+	}
+
+	w.Header().Set("Location", "/api/v1/demos/"+metadata.DemoID)
+	writeAPIJSON(w, http.StatusAccepted, createdDemoResource(r, metadata))
+}
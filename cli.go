@@ -0,0 +1,189 @@
+package main
+
+import (
+	"demovoice/storage"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const extractUsage = `Usage: demovoice extract <demo> [options]
+
+Extracts voice and chat from a .dem or .dem.zst file without starting the
+web server and prints a JSON summary of the outputs to stdout.
+
+Options:
+`
+
+// runExtract implements the "extract" command and returns the exit code
+func runExtract(args []string) int {
+	flags := flag.NewFlagSet("extract", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprint(flags.Output(), extractUsage)
+		flags.PrintDefaults()
+	}
+
+	dir := flags.String("o", "output", "directory to write audio and metadata to")
+	demoID := flags.String("id", "", "demo ID used to name the outputs (default: generated)")
+	chatOnly := flags.Bool("chat-only", false, "extract only chat logs, skipping voice")
+	format := flags.String("format", string(FormatWAV32), "audio format: wav32, wav16 or opus")
+	tickAligned := flags.Bool("tick-aligned", false, "pad each track with silence so it lines up with demo time")
+	mixdown := flags.Bool("mixdown", false, "also write a stereo track of all players")
+	splitRounds := flags.Bool("split-rounds", false, "also write one clip per player per round")
+	quiet := flags.Bool("q", false, "suppress progress logging")
+
+	// Accept options both before and after the demo path
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+	demoPath := flags.Arg(0)
+	if err := flags.Parse(flags.Args()[1:]); err != nil {
+		return 2
+	}
+	if flags.NArg() > 0 {
+		fmt.Fprintf(os.Stderr, "unexpected arguments: %v\n", flags.Args())
+		return 2
+	}
+
+	outputFormat, err := ParseOutputFormat(*format)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	if *quiet {
+		log.SetOutput(io.Discard)
+	}
+
+	if err := os.MkdirAll(*dir, 0755); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to create output directory: %v\n", err)
+		return 1
+	}
+	outputDir = *dir
+	metadataStore = storage.NewMetadataStore(outputDir)
+
+	if *demoID == "" {
+		*demoID = fmt.Sprintf("demo_%d", time.Now().UnixNano())
+	}
+
+	opts := ProcessOptions{
+		ChatOnly:    *chatOnly,
+		TickAligned: *tickAligned,
+		Mixdown:     *mixdown,
+		SplitRounds: *splitRounds,
+		Format:      outputFormat,
+	}
+
+	result, err := ProcessDemo(demoPath, *demoID, *demoID, opts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "extraction failed (%s): %v\n", processingError(err).Code, err)
+		return 1
+	}
+
+	metadata, err := metadataStore.SaveMetadata(*demoID, *demoID, filepath.Base(demoPath))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to save metadata: %v\n", err)
+		return 1
+	}
+
+	applyProcessResult(metadata, result)
+	if err := metadataStore.WriteSubtitles(metadata); err != nil {
+		log.Printf("Warning: Failed to write subtitles: %v", err)
+	}
+	if err := metadataStore.UpdateMetadata(metadata); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to save metadata: %v\n", err)
+		return 1
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(metadata); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to write summary: %v\n", err)
+		return 1
+	}
+
+	return 0
+}
+
+const keysUsage = `Usage:
+  demovoice keys create -name <name> -scopes upload,read [-rate-limit n] [-daily-quota n]
+  demovoice keys list
+  demovoice keys revoke <id>
+
+Manages the API keys accepted by the server. Scopes are upload, read, delete
+and admin. The secret of a new key is printed once and can't be shown again.
+`
+
+// runKeys implements the "keys" command and returns the exit code
+func runKeys(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, keysUsage)
+		return 2
+	}
+
+	store, err := storage.NewAPIKeyStore(filepath.Join(getExecutableDir(), "keys"))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to load API keys: %v\n", err)
+		return 1
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+
+	switch args[0] {
+	case "create":
+		flags := flag.NewFlagSet("keys create", flag.ContinueOnError)
+		name := flags.String("name", "", "name of the client the key is for")
+		scopes := flags.String("scopes", storage.ScopeRead, "comma-separated scopes: upload, read, delete, admin")
+		rateLimit := flags.Int("rate-limit", 0, "requests per minute, 0 for unlimited")
+		dailyQuota := flags.Int("daily-quota", 0, "demos processed per UTC day, 0 for unlimited")
+		if err := flags.Parse(args[1:]); err != nil {
+			return 2
+		}
+
+		key, secret, err := store.Create(*name, strings.Split(*scopes, ","), *rateLimit, *dailyQuota)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		key.Hash = ""
+		encoder.Encode(APIKeyResource{Key: *key, Secret: secret})
+
+	case "list":
+		for _, key := range store.List() {
+			status := "active"
+			if key.Revoked() {
+				status = "revoked"
+			}
+			fmt.Printf("%s\t%s\t%s...\t%s\t%s\n", key.ID, key.Name, key.Prefix, strings.Join(key.Scopes, ","), status)
+		}
+
+	case "revoke":
+		if len(args) != 2 {
+			fmt.Fprint(os.Stderr, keysUsage)
+			return 2
+		}
+		key, err := store.Revoke(args[1])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Printf("revoked %s (%s)\n", key.ID, key.Name)
+
+	default:
+		fmt.Fprint(os.Stderr, keysUsage)
+		return 2
+	}
+
+	return 0
+}
@@ -8,7 +8,7 @@ import (
 )
 
 const (
-	minimumLength = 18
+	minimumLength = 15 // SteamID, one empty section and the checksum
 )
 
 var (
@@ -17,12 +17,56 @@ var (
 	ErrMismatchChecksum   = errors.New("mismatching voice data checksum")
 )
 
+// SectionType identifies a section of a Steam voice payload
+type SectionType byte
+
+const (
+	SectionSilence    SectionType = 0x00 // Value is a number of silent frames
+	SectionLegacy     SectionType = 0x01 // Legacy codec data
+	SectionSilk       SectionType = 0x02 // SILK data
+	SectionRaw        SectionType = 0x03 // Uncompressed PCM
+	SectionOpus       SectionType = 0x05 // Plain Opus frames
+	SectionOpusPLC    SectionType = 0x06 // Sequenced Opus frames, see OpusDecoder
+	SectionSampleRate SectionType = 0x0B // Value is the sample rate of the following sections
+)
+
+// Section is one typed part of a Steam voice payload. Value holds the
+// sample rate or silent frame count of value sections; data sections carry
+// Data and their length in Value.
+type Section struct {
+	Type  SectionType
+	Value uint16
+	Data  []byte
+}
+
+// Known reports whether the section type is one the decoder knows
+func (t SectionType) Known() bool {
+	switch t {
+	case SectionSilence, SectionLegacy, SectionSilk, SectionRaw, SectionOpus, SectionOpusPLC, SectionSampleRate:
+		return true
+	}
+	return false
+}
+
+// hasData reports whether sections of the type are followed by Value bytes
+// of data. Unknown types are assumed to be length-prefixed too, so they can
+// be skipped.
+func (t SectionType) hasData() bool {
+	return t != SectionSilence && t != SectionSampleRate
+}
+
+// Chunk is a decoded Steam voice payload. SampleRate, Length and Data
+// summarize the sections for payloads with one rate and one codec section:
+// the last sample rate, the Opus PLC data (or the silent frame count when
+// there is none) and the concatenated Opus PLC data.
 type Chunk struct {
-	SteamID    uint64
-	SampleRate uint16
-	Length     uint16
-	Data       []byte
-	Checksum   uint32
+	SteamID         uint64
+	SampleRate      uint16
+	Length          uint16
+	Data            []byte
+	Checksum        uint32
+	Sections        []Section
+	UnknownSections int // Sections of a type the decoder does not know
 }
 
 func DecodeChunk(b []byte) (*Chunk, error) {
@@ -38,49 +82,56 @@ func DecodeChunk(b []byte) (*Chunk, error) {
 	chunk.SteamID = binary.LittleEndian.Uint64(b[offset:])
 	offset += 8
 
-	payloadType := b[offset]
-	offset++
-
-	if payloadType != 0x0B {
-		return nil, fmt.Errorf("%w (received %x, expected %x)", ErrInvalidVoicePacket, payloadType, 0x0B)
-	}
-
-	chunk.SampleRate = binary.LittleEndian.Uint16(b[offset:])
-	offset += 2
-
-	voiceType := b[offset]
-	offset++
+	end := bLen - 4
+	for offset < end {
+		section := Section{Type: SectionType(b[offset])}
+		offset++
 
-	chunk.Length = binary.LittleEndian.Uint16(b[offset:])
-	offset += 2
+		if end-offset < 2 {
+			return nil, fmt.Errorf("%w (section %x is truncated)", ErrInvalidVoicePacket, section.Type)
+		}
+		section.Value = binary.LittleEndian.Uint16(b[offset:])
+		offset += 2
 
-	switch voiceType {
-	case 0x6:
-		remaining := bLen - offset - 4
-		chunkLen := int(chunk.Length)
+		if section.Type.hasData() {
+			dataLen := int(section.Value)
+			if remaining := end - offset; remaining < dataLen {
+				return nil, fmt.Errorf("%w (received: %d bytes, expected at least %d bytes)", ErrInsufficientData, bLen, bLen+dataLen-remaining)
+			}
 
-		if remaining < chunkLen {
-			return nil, fmt.Errorf("%w (received: %d bytes, expected at least %d bytes)", ErrInsufficientData, bLen, (bLen + (chunkLen - remaining)))
+			section.Data = b[offset : offset+dataLen]
+			offset += dataLen
 		}
 
-		chunk.Data = b[offset : offset+chunkLen]
-		offset += chunkLen
-	case 0x0:
-		// no-op, detect silence if chunk.Data is empty
-		// the length would the number of silence frames
-	default:
-		return nil, fmt.Errorf("%w (expected 0x6 or 0x0 voice data, received %x)", ErrInvalidVoicePacket, voiceType)
+		switch section.Type {
+		case SectionSampleRate:
+			chunk.SampleRate = section.Value
+		case SectionOpusPLC:
+			if chunk.Data == nil {
+				// Cap the slice so appending another section copies instead of overwriting b
+				chunk.Data = section.Data[:len(section.Data):len(section.Data)]
+			} else {
+				chunk.Data = append(chunk.Data, section.Data...)
+			}
+			chunk.Length = uint16(len(chunk.Data))
+		case SectionSilence:
+			if len(chunk.Data) == 0 {
+				chunk.Length = section.Value
+			}
+		}
+		if !section.Type.Known() {
+			chunk.UnknownSections++
+		}
+		chunk.Sections = append(chunk.Sections, section)
 	}
 
-	remaining := bLen - offset
-
-	if remaining != 4 {
-		return nil, fmt.Errorf("%w (has %d bytes remaining, expected 4 bytes remaining)", ErrInvalidVoicePacket, remaining)
+	if len(chunk.Sections) == 0 {
+		return nil, fmt.Errorf("%w (no sections)", ErrInvalidVoicePacket)
 	}
 
-	chunk.Checksum = binary.LittleEndian.Uint32(b[offset:])
+	chunk.Checksum = binary.LittleEndian.Uint32(b[end:])
 
-	actualChecksum := crc32.ChecksumIEEE(b[0 : bLen-4])
+	actualChecksum := crc32.ChecksumIEEE(b[0:end])
 
 	if chunk.Checksum != actualChecksum {
 		return nil, fmt.Errorf("%w (received %x, expected %x)", ErrMismatchChecksum, chunk.Checksum, actualChecksum)
@@ -7,14 +7,37 @@ import (
 
 const (
 	FrameSize = 480
+
+	// reorderWindow is how many frames behind the expected one a frame may
+	// be and still count as late or duplicated. A frame further behind means
+	// the sender restarted its counter without a reset marker.
+	reorderWindow = 64
 )
 
+// LossStats counts Steam voice frames that were lost in transit
+type LossStats struct {
+	Recovered int // Rebuilt from the FEC data of the following frame
+	Concealed int // Filled in by packet loss concealment
+	Late      int // Arrived after their gap was filled, and dropped
+}
+
+// frameDecoder decodes single Opus frames. It is implemented by
+// *opus.Decoder; tests use a fake to check how lost frames are filled in.
+type frameDecoder interface {
+	DecodeFloat32(data []byte, pcm []float32) (int, error)
+	DecodeFECFloat32(data []byte, pcm []float32) error
+	DecodePLCFloat32(pcm []float32) error
+}
+
 type OpusDecoder struct {
-	decoder *opus.Decoder
+	decoder frameDecoder
 
+	// Sequence number of the next expected frame, once synced to the stream
 	currentFrame uint16
+	synced       bool
 	// Reusable decode buffer
 	decodeBuf []float32
+	stats     LossStats
 }
 
 func NewOpusDecoder(sampleRate, channels int) (*OpusDecoder, error) {
@@ -45,7 +68,7 @@ func (d *OpusDecoder) DecodeInto(b []byte, output []float32) ([]float32, error)
 		b = b[2:]
 
 		if chunkLen == -1 {
-			d.currentFrame = 0
+			d.synced = false
 			break
 		}
 
@@ -67,24 +90,33 @@ func (d *OpusDecoder) DecodeInto(b []byte, output []float32) ([]float32, error)
 		chunk := b[:chunkLen]
 		b = b[chunkLen:]
 
-		previousFrame := d.currentFrame
+		// Nothing can have been lost before the first frame of a stream
+		if !d.synced {
+			d.currentFrame = currentFrame
+			d.synced = true
+		}
 
-		if currentFrame >= previousFrame {
-			if currentFrame > previousFrame {
-				var err error
-				output, err = d.decodeLossInto(currentFrame-previousFrame, output)
-				if err != nil {
-					return nil, err
-				}
-			}
+		// Frame counters wrap at 65535, so compare them by signed distance
+		ahead := int16(currentFrame - d.currentFrame)
+		if ahead < 0 && ahead >= -reorderWindow {
+			d.stats.Late++
+			continue
+		}
 
+		if ahead > 0 {
 			var err error
-			output, err = d.decodeSteamChunkInto(chunk, output)
+			output, err = d.decodeLossInto(uint16(ahead), chunk, output)
 			if err != nil {
 				return nil, err
 			}
-			d.currentFrame = currentFrame + 1
 		}
+
+		var err error
+		output, err = d.decodeSteamChunkInto(chunk, output)
+		if err != nil {
+			return nil, err
+		}
+		d.currentFrame = currentFrame + 1
 	}
 
 	return output, nil
@@ -103,22 +135,90 @@ func (d *OpusDecoder) decodeSteamChunkInto(b []byte, output []float32) ([]float3
 	return append(output, d.decodeBuf[:n]...), nil
 }
 
-func (d *OpusDecoder) decodeLoss(samples uint16) ([]float32, error) {
-	return d.decodeLossInto(samples, make([]float32, 0, FrameSize*int(samples)))
+// Stats returns how many lost frames were recovered or concealed so far
+func (d *OpusDecoder) Stats() LossStats {
+	return d.stats
+}
+
+func (d *OpusDecoder) decodeLoss(frames uint16, next []byte) ([]float32, error) {
+	return d.decodeLossInto(frames, next, make([]float32, 0, FrameSize*int(frames)))
 }
 
-func (d *OpusDecoder) decodeLossInto(samples uint16, output []float32) ([]float32, error) {
-	loss := min(samples, 10)
+// decodeLossInto fills a gap of lost frames before the frame next. The last
+// lost frame is rebuilt from the in-band FEC data of next when it carries
+// any; the others are concealed with PLC, up to 10 frames in total.
+func (d *OpusDecoder) decodeLossInto(frames uint16, next []byte, output []float32) ([]float32, error) {
+	loss := min(frames, 10)
 
-	for i := 0; i < int(loss); i += 1 {
+	for i := 1; i < int(loss); i += 1 {
 		if err := d.decoder.DecodePLCFloat32(d.decodeBuf); err != nil {
 			return nil, err
 		}
 
 		output = append(output, d.decodeBuf...)
+		d.stats.Concealed++
 	}
 
-	return output, nil
+	if hasFEC(next) {
+		if err := d.decoder.DecodeFECFloat32(next, d.decodeBuf); err == nil {
+			d.stats.Recovered++
+			return append(output, d.decodeBuf...), nil
+		}
+	}
+
+	if err := d.decoder.DecodePLCFloat32(d.decodeBuf); err != nil {
+		return nil, err
+	}
+	d.stats.Concealed++
+	return append(output, d.decodeBuf...), nil
+}
+
+// hasFEC reports whether an Opus packet carries in-band FEC (SILK LBRR) data
+// for the previous frame. CELT-only packets never do. Like libopus'
+// opus_packet_has_lbrr, it reads the LBRR flag of the first frame, which
+// follows the VAD flags of each 20 ms SILK frame.
+func hasFEC(packet []byte) bool {
+	if len(packet) < 2 {
+		return false
+	}
+
+	toc := packet[0]
+	config := toc >> 3
+	if config >= 16 {
+		return false
+	}
+
+	// SILK-only configs use 10, 20, 40 or 60 ms frames, hybrid 10 or 20 ms
+	var frameMs int
+	if config < 12 {
+		frameMs = []int{10, 20, 40, 60}[config%4]
+	} else {
+		frameMs = []int{10, 20}[config%2]
+	}
+	silkFrames := max(frameMs/20, 1)
+
+	// Find where the first frame starts
+	start := 1
+	switch toc & 0x3 {
+	case 2:
+		start = 2
+		if packet[1] >= 252 {
+			start = 3
+		}
+	case 3:
+		// Code 3 packets need a full parse; don't guess
+		return false
+	}
+	if start >= len(packet) {
+		return false
+	}
+
+	first := packet[start]
+	lbrr := (first>>(7-silkFrames))&1 == 1
+	if toc&0x4 != 0 {
+		lbrr = lbrr || (first>>(6-2*silkFrames))&1 == 1
+	}
+	return lbrr
 }
 
 type RawOpusDecoder struct {
@@ -0,0 +1,263 @@
+package decoder
+
+import (
+	"encoding/binary"
+	"errors"
+	"slices"
+	"testing"
+)
+
+// steamFrame is one frame of a Steam Opus PLC section
+type steamFrame struct {
+	counter uint16
+	data    []byte
+}
+
+// fakeFrameDecoder records which kind of decode OpusDecoder asked for, so
+// the handling of lost frames is tested without libopus
+type fakeFrameDecoder struct {
+	calls  []string // "decode", "fec" or "plc", in order
+	fecErr error    // Returned by DecodeFECFloat32
+}
+
+func (f *fakeFrameDecoder) DecodeFloat32(data []byte, pcm []float32) (int, error) {
+	f.calls = append(f.calls, "decode")
+	return len(pcm), nil
+}
+
+func (f *fakeFrameDecoder) DecodeFECFloat32(data []byte, pcm []float32) error {
+	f.calls = append(f.calls, "fec")
+	return f.fecErr
+}
+
+func (f *fakeFrameDecoder) DecodePLCFloat32(pcm []float32) error {
+	f.calls = append(f.calls, "plc")
+	return nil
+}
+
+// newTestDecoder returns an OpusDecoder backed by a fake frame decoder
+func newTestDecoder(frames *fakeFrameDecoder) *OpusDecoder {
+	return &OpusDecoder{decoder: frames, decodeBuf: make([]float32, FrameSize)}
+}
+
+// silkPacket is a 20 ms narrowband SILK-only Opus packet, with or without
+// the LBRR flag that announces in-band FEC data for the previous frame. Only
+// the TOC byte and the flags are read; the rest is never decoded.
+func silkPacket(fec bool) []byte {
+	first := byte(0x80) // VAD flag of the first SILK frame
+	if fec {
+		first |= 0x40 // LBRR flag
+	}
+	return []byte{0x08, first, 0x5a, 0x3c, 0x91, 0x07, 0xe2, 0x4d}
+}
+
+// frame returns a frame with the given counter and a packet without FEC data
+func frame(counter uint16) steamFrame {
+	return steamFrame{counter: counter, data: silkPacket(false)}
+}
+
+// sectionData encodes frames as [int16 length][uint16 counter][opus packet]
+func sectionData(frames ...steamFrame) []byte {
+	var b []byte
+	for _, f := range frames {
+		b = binary.LittleEndian.AppendUint16(b, uint16(len(f.data)))
+		b = binary.LittleEndian.AppendUint16(b, f.counter)
+		b = append(b, f.data...)
+	}
+	return b
+}
+
+// resetMarker is the -1 length that ends a stream
+var resetMarker = []byte{0xff, 0xff}
+
+func TestOpusDecoderFrameCounters(t *testing.T) {
+	tests := []struct {
+		name    string
+		packets [][]byte // Each packet is passed to one DecodeInto call
+		fecErr  error
+		stats   LossStats
+		next    uint16   // Counter of the next expected frame
+		calls   []string // Frame decodes in order, when checked
+	}{
+		{
+			name:    "in order",
+			packets: [][]byte{sectionData(frame(0), frame(1)), sectionData(frame(2))},
+			next:    3,
+		},
+		{
+			name:    "wraparound",
+			packets: [][]byte{sectionData(frame(0xfffe), frame(0xffff)), sectionData(frame(0), frame(1))},
+			next:    2,
+		},
+		{
+			name:    "gap across wraparound",
+			packets: [][]byte{sectionData(frame(0xffff)), sectionData(frame(2))},
+			stats:   LossStats{Concealed: 2},
+			next:    3,
+		},
+		{
+			name:    "late frame inside the window",
+			packets: [][]byte{sectionData(frame(10), frame(11), frame(13)), sectionData(frame(12))},
+			stats:   LossStats{Concealed: 1, Late: 1},
+			next:    14,
+		},
+		{
+			name:    "late frame across wraparound",
+			packets: [][]byte{sectionData(frame(0xffff), frame(0), frame(1)), sectionData(frame(0xffff))},
+			stats:   LossStats{Late: 1},
+			next:    2,
+		},
+		{
+			name:    "late frame at the edge of the window",
+			packets: [][]byte{sectionData(frame(100)), sectionData(frame(100 - reorderWindow + 1))},
+			stats:   LossStats{Late: 1},
+			next:    101,
+		},
+		{
+			name:    "duplicate frame",
+			packets: [][]byte{sectionData(frame(5), frame(5)), sectionData(frame(6), frame(6))},
+			stats:   LossStats{Late: 2},
+			next:    7,
+		},
+		{
+			name:    "gap behind the window resyncs",
+			packets: [][]byte{sectionData(frame(1000)), sectionData(frame(1000-reorderWindow-1), frame(1000-reorderWindow))},
+			next:    1000 - reorderWindow + 1,
+		},
+		{
+			name:    "gap ahead conceals at most 10 frames",
+			packets: [][]byte{sectionData(frame(0)), sectionData(frame(500))},
+			stats:   LossStats{Concealed: 10},
+			next:    501,
+		},
+		{
+			name:    "reset marker resyncs",
+			packets: [][]byte{sectionData(frame(7)), append(sectionData(frame(8)), resetMarker...), sectionData(frame(300))},
+			next:    301,
+		},
+		{
+			name: "PLC then FEC",
+			packets: [][]byte{
+				sectionData(frame(0)),
+				sectionData(steamFrame{counter: 4, data: silkPacket(true)}),
+			},
+			stats: LossStats{Recovered: 1, Concealed: 2},
+			next:  5,
+			calls: []string{"decode", "plc", "plc", "fec", "decode"},
+		},
+		{
+			name:    "PLC only without FEC data",
+			packets: [][]byte{sectionData(frame(0)), sectionData(frame(4))},
+			stats:   LossStats{Concealed: 3},
+			next:    5,
+			calls:   []string{"decode", "plc", "plc", "plc", "decode"},
+		},
+		{
+			name: "PLC when FEC decoding fails",
+			packets: [][]byte{
+				sectionData(frame(0)),
+				sectionData(steamFrame{counter: 3, data: silkPacket(true)}),
+			},
+			fecErr: errors.New("corrupted stream"),
+			stats:  LossStats{Concealed: 2},
+			next:   4,
+			calls:  []string{"decode", "plc", "fec", "plc", "decode"},
+		},
+		{
+			name: "FEC for a single lost frame",
+			packets: [][]byte{
+				sectionData(frame(0)),
+				sectionData(steamFrame{counter: 2, data: silkPacket(true)}),
+			},
+			stats: LossStats{Recovered: 1},
+			next:  3,
+			calls: []string{"decode", "fec", "decode"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			frames := &fakeFrameDecoder{fecErr: tt.fecErr}
+			d := newTestDecoder(frames)
+
+			samples := 0
+			for i, packet := range tt.packets {
+				pcm, err := d.DecodeInto(packet, nil)
+				if err != nil {
+					t.Fatalf("packet %d: DecodeInto: %v", i, err)
+				}
+				samples += len(pcm)
+			}
+
+			// Every decoded, recovered or concealed frame adds one frame of audio
+			if want := len(frames.calls) * FrameSize; tt.fecErr == nil && samples != want {
+				t.Errorf("got %d samples, want %d", samples, want)
+			}
+			if tt.calls != nil && !slices.Equal(frames.calls, tt.calls) {
+				t.Errorf("frame decodes = %v, want %v", frames.calls, tt.calls)
+			}
+
+			if stats := d.Stats(); stats != tt.stats {
+				t.Errorf("stats = %+v, want %+v", stats, tt.stats)
+			}
+			if !d.synced {
+				t.Errorf("decoder is not synced")
+			} else if d.currentFrame != tt.next {
+				t.Errorf("next frame = %d, want %d", d.currentFrame, tt.next)
+			}
+		})
+	}
+}
+
+func TestOpusDecoderInvalidPackets(t *testing.T) {
+	tests := []struct {
+		name   string
+		packet []byte
+	}{
+		{name: "truncated length", packet: []byte{0x04}},
+		{name: "missing counter", packet: []byte{0x04, 0x00}},
+		{name: "truncated frame", packet: []byte{0x04, 0x00, 0x01, 0x00, 0x08}},
+		{name: "negative length", packet: []byte{0xfe, 0xff, 0x01, 0x00}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := newTestDecoder(&fakeFrameDecoder{})
+			if _, err := d.DecodeInto(tt.packet, nil); !errors.Is(err, ErrInvalidVoicePacket) {
+				t.Errorf("DecodeInto error = %v, want %v", err, ErrInvalidVoicePacket)
+			}
+		})
+	}
+}
+
+func TestHasFEC(t *testing.T) {
+	tests := []struct {
+		name   string
+		packet []byte
+		want   bool
+	}{
+		{name: "empty", packet: nil},
+		{name: "TOC only", packet: []byte{0x08}},
+		{name: "SILK 20 ms with LBRR", packet: []byte{0x08, 0xc0}, want: true},
+		{name: "SILK 20 ms without LBRR", packet: []byte{0x08, 0x80}},
+		{name: "SILK 10 ms with LBRR", packet: []byte{0x00, 0x40}, want: true},
+		{name: "SILK 40 ms with LBRR", packet: []byte{0x10, 0x20}, want: true},
+		{name: "SILK 60 ms with LBRR", packet: []byte{0x18, 0x10}, want: true},
+		{name: "SILK 40 ms VAD flags only", packet: []byte{0x10, 0xc0}},
+		{name: "stereo with side channel LBRR", packet: []byte{0x0c, 0x10}, want: true},
+		{name: "hybrid 20 ms with LBRR", packet: []byte{0x68, 0x40}, want: true},
+		{name: "CELT only", packet: []byte{0x80, 0xff}},
+		{name: "code 2 with LBRR", packet: []byte{0x0a, 0x01, 0x40}, want: true},
+		{name: "code 2 with a two byte length", packet: []byte{0x0a, 0xfc, 0x01, 0x40}, want: true},
+		{name: "code 2 truncated", packet: []byte{0x0a, 0xfc, 0x01}},
+		{name: "code 3", packet: []byte{0x0b, 0x40, 0x40}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := hasFEC(tt.packet); got != tt.want {
+				t.Errorf("hasFEC(%x) = %v, want %v", tt.packet, got, tt.want)
+			}
+		})
+	}
+}
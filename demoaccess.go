@@ -0,0 +1,83 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"demovoice/storage"
+	"encoding/hex"
+	"net/http"
+	"time"
+)
+
+// demoAccessCookie holds the access token of the demo in current_demo_id
+const demoAccessCookie = "demo_access"
+
+// demoAccessToken is the credential that lets the web UI, and anyone it
+// shares a link with, read one demo without an API key. It is signed with
+// the output URL key, so rotating that key revokes every token.
+func demoAccessToken(demoID string) string {
+	mac := hmac.New(sha256.New, outputURLKey)
+	mac.Write([]byte("demo\n" + demoID))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// hasDemoAccess reports whether a request carries the access token of a
+// demo, as ?access= or in the session cookie
+func hasDemoAccess(r *http.Request, demoID string) bool {
+	if demoID == "" {
+		return false
+	}
+
+	token := r.URL.Query().Get("access")
+	if token == "" && getCurrentDemoID(r) == demoID {
+		if cookie, err := r.Cookie(demoAccessCookie); err == nil {
+			token = cookie.Value
+		}
+	}
+	return token != "" && hmac.Equal([]byte(token), []byte(demoAccessToken(demoID)))
+}
+
+// setCurrentDemo makes a demo the session's current demo and grants the
+// browser access to it
+func setCurrentDemo(w http.ResponseWriter, demoID string) {
+	expires := time.Now().Add(24 * time.Hour)
+	http.SetCookie(w, &http.Cookie{
+		Name:    "current_demo_id",
+		Value:   demoID,
+		Path:    "/",
+		Expires: expires,
+	})
+	http.SetCookie(w, &http.Cookie{
+		Name:     demoAccessCookie,
+		Value:    demoAccessToken(demoID),
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// authorizeDemoRequest checks that a request may read a demo: it carries the
+// demo's access token or an API key with the read scope. Without configured
+// keys the API is open and any request is allowed. signed reports whether the
+// caller was authenticated and may be handed signed output URLs.
+func authorizeDemoRequest(w http.ResponseWriter, r *http.Request, demoID string) (signed, ok bool) {
+	if hasDemoAccess(r, demoID) {
+		return true, true
+	}
+
+	key, ok := authorizeAPIRequest(w, r, storage.ScopeRead)
+	return key != nil, ok
+}
+
+// authorizeWebRequest checks a request to an endpoint the web UI uses that is
+// not about a single demo: it comes from a browser session with access to its
+// current demo, or carries an API key with the read scope
+func authorizeWebRequest(w http.ResponseWriter, r *http.Request) bool {
+	if hasDemoAccess(r, getCurrentDemoID(r)) {
+		return true
+	}
+
+	_, ok := authorizeAPIRequest(w, r, storage.ScopeRead)
+	return ok
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const defaultMaxUploadMB = 2048
+
+// maxUploadSize is the largest demo accepted, in bytes (MAX_UPLOAD_MB)
+var maxUploadSize int64 = defaultMaxUploadMB << 20
+
+var (
+	demoMagic = []byte("PBDEMS2\x00")          // Start of every CS2 demo
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd} // Start of a zstd frame
+)
+
+// ErrNotADemo is returned when an upload is neither a CS2 demo nor a zstd-compressed one
+var ErrNotADemo = errors.New("file is not a CS2 demo (.dem or .dem.zst)")
+
+// ErrDemoTooLarge is returned when an upload exceeds maxUploadSize
+var ErrDemoTooLarge = errors.New("demo file is too large")
+
+// demoExtension returns the extension to store a demo under from its first
+// bytes: ".dem" for a demo, ".dem.zst" for a compressed one
+func demoExtension(head []byte) (string, error) {
+	switch {
+	case bytes.HasPrefix(head, demoMagic):
+		return ".dem", nil
+	case bytes.HasPrefix(head, zstdMagic):
+		return ".dem.zst", nil
+	}
+	return "", ErrNotADemo
+}
+
+// newUploadPath returns a fresh server-generated path in the upload
+// directory. Client filenames are only kept as metadata, so uploads can't
+// overwrite each other or escape the directory.
+func newUploadPath(ext string) string {
+	idBytes := make([]byte, 12)
+	rand.Read(idBytes)
+	return filepath.Join(uploadDir, "upload_"+hex.EncodeToString(idBytes)+ext)
+}
+
+// maxFormFieldSize limits each text field sent along with an upload
+const maxFormFieldSize = 64 << 10
+
+// formDemoFile finds the "demo" file of a multipart upload and returns it as
+// a stream, together with the client's filename, without buffering the file
+// anywhere. Files that don't start like a demo are rejected after their
+// first bytes, and the request body is stopped once it exceeds
+// maxUploadSize. Text fields are added to r.Form, so r.FormValue can read
+// them; the query string is always available there. Fields sent after the
+// file are only there once the file has been read to the end.
+func formDemoFile(w http.ResponseWriter, r *http.Request) (io.Reader, string, error) {
+	// Leave room for the multipart framing and the other form fields
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize+1<<20)
+
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return nil, "", err
+	}
+
+	// Parsing the form now would read the whole file, so it is filled in here
+	r.Form = r.URL.Query()
+	r.PostForm = url.Values{}
+
+	for {
+		part, err := nextFormPart(reader)
+		if err == io.EOF {
+			return nil, "", http.ErrMissingFile
+		}
+		if err != nil {
+			return nil, "", err
+		}
+
+		if part.FormName() == "demo" && part.FileName() != "" {
+			file := bufio.NewReader(part)
+			head, _ := file.Peek(len(demoMagic))
+			if _, err := demoExtension(head); err != nil {
+				return nil, "", err
+			}
+			return &formFileReader{Reader: file, r: r, form: reader}, part.FileName(), nil
+		}
+
+		if err := addFormField(r, part); err != nil {
+			return nil, "", err
+		}
+	}
+}
+
+// formFileReader reads the demo file of a multipart upload. At the end of
+// the file it reads the rest of the form, so fields sent after the file
+// reach r.Form before the reader reports io.EOF.
+type formFileReader struct {
+	*bufio.Reader
+	r    *http.Request
+	form *multipart.Reader
+	done bool
+}
+
+func (f *formFileReader) Read(p []byte) (int, error) {
+	n, err := f.Reader.Read(p)
+	if err != io.EOF || f.done {
+		return n, err
+	}
+	f.done = true
+
+	for {
+		part, err := nextFormPart(f.form)
+		if err == io.EOF {
+			return n, io.EOF
+		}
+		if err != nil {
+			return n, err
+		}
+		if err := addFormField(f.r, part); err != nil {
+			return n, err
+		}
+	}
+}
+
+// nextFormPart returns the next part of a multipart upload, reporting a body
+// over the size limit as ErrDemoTooLarge
+func nextFormPart(reader *multipart.Reader) (*multipart.Part, error) {
+	part, err := reader.NextPart()
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return nil, ErrDemoTooLarge
+	}
+	return part, err
+}
+
+// addFormField adds a text field of a multipart upload to r.Form. Other
+// files are skipped.
+func addFormField(r *http.Request, part *multipart.Part) error {
+	if part.FileName() != "" {
+		return nil
+	}
+
+	value, err := io.ReadAll(io.LimitReader(part, maxFormFieldSize))
+	if err != nil {
+		return err
+	}
+	r.Form.Add(part.FormName(), string(value))
+	r.PostForm.Add(part.FormName(), string(value))
+	return nil
+}
+
+// saveDemoUpload streams an uploaded demo to a new file in the upload
+// directory and returns its path and content hash. Files that don't start
+// like a demo are rejected before anything is written, and the size limit is
+// enforced while copying.
+func saveDemoUpload(file io.Reader) (string, string, error) {
+	reader := bufio.NewReader(file)
+	head, _ := reader.Peek(len(demoMagic))
+	ext, err := demoExtension(head)
+	if err != nil {
+		return "", "", err
+	}
+
+	path := newUploadPath(ext)
+	out, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return "", "", fmt.Errorf("error saving file: %w", err)
+	}
+
+	// Read one byte more than allowed to detect oversized files
+	hasher := newContentHasher(ext == ".dem.zst")
+	n, err := io.Copy(io.MultiWriter(out, hasher), io.LimitReader(reader, maxUploadSize+1))
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	sum, hashErr := hasher.Sum()
+
+	var tooLarge *http.MaxBytesError
+	switch {
+	case n > maxUploadSize || errors.As(err, &tooLarge):
+		err = ErrDemoTooLarge
+	case errors.Is(err, ErrNotADemo):
+	case err != nil:
+		err = fmt.Errorf("error saving file: %w", err)
+	case hashErr != nil:
+		err = hashErr
+	case ext == ".dem.zst":
+		err = checkCompressedDemo(path)
+	}
+	if err != nil {
+		os.Remove(path)
+		return "", "", err
+	}
+	return path, sum, nil
+}
+
+// contentHasher hashes a demo as it is written. Compressed demos are hashed
+// after decompression, so a .dem and its .dem.zst have the same hash.
+type contentHasher struct {
+	hash hash.Hash
+	pipe *io.PipeWriter // Feeds the decompressor of a compressed demo
+	done chan error
+}
+
+func newContentHasher(compressed bool) *contentHasher {
+	h := &contentHasher{hash: sha256.New()}
+	if !compressed {
+		return h
+	}
+
+	reader, writer := io.Pipe()
+	h.pipe = writer
+	h.done = make(chan error, 1)
+	go func() {
+		decoder, err := zstd.NewReader(reader, zstd.WithDecoderConcurrency(1))
+		if err == nil {
+			_, err = io.Copy(h.hash, decoder)
+			decoder.Close()
+		}
+		// Unblock the writer when the data doesn't decompress
+		reader.CloseWithError(err)
+		h.done <- err
+	}()
+	return h
+}
+
+func (h *contentHasher) Write(p []byte) (int, error) {
+	if h.pipe == nil {
+		return h.hash.Write(p)
+	}
+
+	n, err := h.pipe.Write(p)
+	if err != nil {
+		// The decompressor stopped, so this is not a zstd stream
+		return n, ErrNotADemo
+	}
+	return n, nil
+}
+
+// Sum finishes hashing and returns "sha256:<hex>". It must be called even
+// when writing failed, to stop the decompressor.
+func (h *contentHasher) Sum() (string, error) {
+	if h.pipe != nil {
+		h.pipe.Close()
+		if err := <-h.done; err != nil {
+			return "", ErrNotADemo
+		}
+	}
+	return "sha256:" + hex.EncodeToString(h.hash.Sum(nil)), nil
+}
+
+// fileContentHash returns the content hash of a stored demo
+func fileContentHash(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hasher := newContentHasher(filepath.Ext(path) == ".zst")
+	_, err = io.Copy(hasher, file)
+	sum, hashErr := hasher.Sum()
+	if err != nil {
+		return "", err
+	}
+	return sum, hashErr
+}
+
+// checkDemoHeader checks the first bytes of a stored file and returns the
+// extension it should have
+func checkDemoHeader(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	head := make([]byte, len(demoMagic))
+	n, _ := io.ReadFull(file, head)
+	return demoExtension(head[:n])
+}
+
+// checkDemoFile checks that a complete stored file is a demo, including the
+// contents of a compressed one, and returns the extension it should have
+func checkDemoFile(path string) (string, error) {
+	ext, err := checkDemoHeader(path)
+	if err == nil && ext == ".dem.zst" {
+		err = checkCompressedDemo(path)
+	}
+	return ext, err
+}
+
+// checkCompressedDemo checks that a zstd file decompresses to a demo
+func checkCompressedDemo(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	decoder, err := zstd.NewReader(file, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return ErrNotADemo
+	}
+	defer decoder.Close()
+
+	head := make([]byte, len(demoMagic))
+	if _, err := io.ReadFull(decoder, head); err != nil || !bytes.Equal(head, demoMagic) {
+		return ErrNotADemo
+	}
+	return nil
+}
+
+// uploadErrorStatus maps an error from receiving or saving a demo to an HTTP status
+func uploadErrorStatus(err error, fallback int) int {
+	switch {
+	case errors.Is(err, ErrNotADemo):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrDemoTooLarge):
+		return http.StatusRequestEntityTooLarge
+	}
+	return fallback
+}
+
+// setMaxUploadSize reads MAX_UPLOAD_MB
+func setMaxUploadSize() {
+	maxUploadSize = int64(envInt("MAX_UPLOAD_MB", defaultMaxUploadMB)) << 20
+}
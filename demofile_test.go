@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestFormDemoFileFieldsAfterFile(t *testing.T) {
+	uploadDir = t.TempDir()
+	demo := append(append([]byte{}, demoMagic...), bytes.Repeat([]byte{0x2a}, 64<<10)...)
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	form.WriteField("note", "before the file")
+	part, err := form.CreateFormFile("demo", "match.dem")
+	if err != nil {
+		t.Fatalf("CreateFormFile: %v", err)
+	}
+	part.Write(demo)
+	form.WriteField("callback_url", "https://example.com/hook")
+	form.WriteField("callback_secret", "s3cret")
+	form.Close()
+
+	r := httptest.NewRequest("POST", "/api/upload", &body)
+	r.Header.Set("Content-Type", form.FormDataContentType())
+
+	file, filename, err := formDemoFile(httptest.NewRecorder(), r)
+	if err != nil {
+		t.Fatalf("formDemoFile: %v", err)
+	}
+	if filename != "match.dem" {
+		t.Errorf("filename = %q, want %q", filename, "match.dem")
+	}
+	if got := r.FormValue("note"); got != "before the file" {
+		t.Errorf("note = %q, want %q", got, "before the file")
+	}
+
+	path, _, err := saveDemoUpload(file)
+	if err != nil {
+		t.Fatalf("saveDemoUpload: %v", err)
+	}
+	saved, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("reading saved demo: %v", err)
+	}
+	if !bytes.Equal(saved, demo) {
+		t.Errorf("saved %d bytes, want the %d bytes of the demo", len(saved), len(demo))
+	}
+
+	callback, err := webhookTargetFromRequest(r)
+	if err != nil {
+		t.Fatalf("webhookTargetFromRequest: %v", err)
+	}
+	if callback == nil {
+		t.Fatal("callback_url sent after the file was dropped")
+	}
+	if callback.URL != "https://example.com/hook" || callback.Secret != "s3cret" {
+		t.Errorf("callback = %q with secret %q, want https://example.com/hook with s3cret", callback.URL, callback.Secret)
+	}
+}
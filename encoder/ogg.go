@@ -0,0 +1,110 @@
+package encoder
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+const (
+	oggHeaderContinued = 0x01
+	oggHeaderBOS       = 0x02
+	oggHeaderEOS       = 0x04
+
+	// Segments in a page's lacing table, limited by its single-byte count
+	oggMaxSegments = 255
+)
+
+// oggCRCTable is the CRC-32 table used by Ogg (polynomial 0x04c11db7, no
+// reflection), which differs from the IEEE table in hash/crc32
+var oggCRCTable = func() [256]uint32 {
+	var table [256]uint32
+	for i := range table {
+		crc := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04c11db7
+			} else {
+				crc <<= 1
+			}
+		}
+		table[i] = crc
+	}
+	return table
+}()
+
+func oggCRC(b []byte) uint32 {
+	var crc uint32
+	for _, v := range b {
+		crc = crc<<8 ^ oggCRCTable[byte(crc>>24)^v]
+	}
+	return crc
+}
+
+// oggStream writes packets of a single logical bitstream into Ogg pages
+type oggStream struct {
+	w       io.Writer
+	serial  uint32
+	pageSeq uint32
+
+	// Packets buffered for the next page
+	segments []byte
+	data     []byte
+	granule  uint64
+}
+
+// lacingSegments returns the number of lacing values needed for a packet
+func lacingSegments(packetLen int) int {
+	return packetLen/255 + 1
+}
+
+// WritePacket buffers a packet that ends at the given granule position,
+// flushing the current page first if the packet would not fit on it
+func (s *oggStream) WritePacket(packet []byte, granule uint64) error {
+	if len(s.segments)+lacingSegments(len(packet)) > oggMaxSegments {
+		if err := s.Flush(0); err != nil {
+			return err
+		}
+	}
+
+	for n := len(packet); ; n -= 255 {
+		if n < 255 {
+			s.segments = append(s.segments, byte(n))
+			break
+		}
+		s.segments = append(s.segments, 255)
+	}
+	s.data = append(s.data, packet...)
+	s.granule = granule
+	return nil
+}
+
+// Pending returns the number of bytes buffered for the next page
+func (s *oggStream) Pending() int {
+	return len(s.data)
+}
+
+// Flush writes the buffered packets as a page with the given header flags
+func (s *oggStream) Flush(headerType byte) error {
+	if len(s.segments) == 0 && headerType&oggHeaderEOS == 0 {
+		return nil
+	}
+
+	page := make([]byte, 27, 27+len(s.segments)+len(s.data))
+	copy(page, "OggS")
+	page[4] = 0 // Stream structure version
+	page[5] = headerType
+	binary.LittleEndian.PutUint64(page[6:], s.granule)
+	binary.LittleEndian.PutUint32(page[14:], s.serial)
+	binary.LittleEndian.PutUint32(page[18:], s.pageSeq)
+	page[26] = byte(len(s.segments))
+	page = append(page, s.segments...)
+	page = append(page, s.data...)
+	binary.LittleEndian.PutUint32(page[22:], oggCRC(page))
+
+	s.pageSeq++
+	s.segments = s.segments[:0]
+	s.data = s.data[:0]
+
+	_, err := s.w.Write(page)
+	return err
+}
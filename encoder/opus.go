@@ -0,0 +1,182 @@
+package encoder
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"gopkg.in/hraban/opus.v2"
+)
+
+const (
+	// Ogg Opus granule positions are always counted at 48 kHz
+	granuleRate = 48000
+
+	// preSkip is the libopus encoder lookahead at 48 kHz (Fs/400 + Fs/250),
+	// which decoders discard from the start of the stream
+	preSkip = 312
+
+	frameDuration = 20 * time.Millisecond
+
+	// Flush a page roughly every second of audio
+	pageTargetBytes = 4096
+
+	// Large enough for any single Opus packet
+	maxPacketSize = 4000
+
+	vendorString = "demovoice"
+)
+
+var ErrUnsupportedSampleRate = errors.New("unsupported Opus sample rate")
+
+// SupportedSampleRate reports whether libopus can encode at the given rate
+func SupportedSampleRate(sampleRate int) bool {
+	switch sampleRate {
+	case 8000, 12000, 16000, 24000, 48000:
+		return true
+	}
+	return false
+}
+
+// OggOpusWriter encodes float PCM into an Ogg Opus stream (RFC 7845)
+type OggOpusWriter struct {
+	stream     *oggStream
+	encoder    *opus.Encoder
+	sampleRate int
+	channels   int
+	frameSize  int // Samples per channel in one frame at the input rate
+
+	pending      []float32 // Interleaved samples not yet forming a full frame
+	packet       []byte
+	inputSamples uint64 // Samples per channel received so far
+	granule      uint64 // 48 kHz samples encoded so far, including pre-skip
+	closed       bool
+}
+
+// NewOggOpusWriter creates a writer that encodes PCM at sampleRate with the
+// given number of interleaved channels
+func NewOggOpusWriter(w io.Writer, sampleRate, channels int, serial uint32) (*OggOpusWriter, error) {
+	if !SupportedSampleRate(sampleRate) {
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedSampleRate, sampleRate)
+	}
+
+	enc, err := opus.NewEncoder(sampleRate, channels, opus.AppVoIP)
+	if err != nil {
+		return nil, err
+	}
+	if err := enc.SetBitrate(32000 * channels); err != nil {
+		return nil, err
+	}
+
+	writer := &OggOpusWriter{
+		stream:     &oggStream{w: w, serial: serial},
+		encoder:    enc,
+		sampleRate: sampleRate,
+		channels:   channels,
+		frameSize:  sampleRate * int(frameDuration/time.Millisecond) / 1000,
+		packet:     make([]byte, maxPacketSize),
+	}
+
+	if err := writer.writeHeaders(); err != nil {
+		return nil, err
+	}
+
+	return writer, nil
+}
+
+func (o *OggOpusWriter) writeHeaders() error {
+	head := make([]byte, 19)
+	copy(head, "OpusHead")
+	head[8] = 1 // Version
+	head[9] = byte(o.channels)
+	binary.LittleEndian.PutUint16(head[10:], preSkip)
+	binary.LittleEndian.PutUint32(head[12:], uint32(o.sampleRate))
+	binary.LittleEndian.PutUint16(head[16:], 0) // Output gain
+	head[18] = 0                                // Channel mapping family
+
+	if err := o.stream.WritePacket(head, 0); err != nil {
+		return err
+	}
+	if err := o.stream.Flush(oggHeaderBOS); err != nil {
+		return err
+	}
+
+	tags := make([]byte, 0, 8+4+len(vendorString)+4)
+	tags = append(tags, "OpusTags"...)
+	tags = binary.LittleEndian.AppendUint32(tags, uint32(len(vendorString)))
+	tags = append(tags, vendorString...)
+	tags = binary.LittleEndian.AppendUint32(tags, 0) // No user comments
+
+	if err := o.stream.WritePacket(tags, 0); err != nil {
+		return err
+	}
+	return o.stream.Flush(0)
+}
+
+// Write encodes interleaved PCM samples
+func (o *OggOpusWriter) Write(pcm []float32) error {
+	if o.closed {
+		return errors.New("write to closed Ogg Opus writer")
+	}
+
+	o.inputSamples += uint64(len(pcm) / o.channels)
+	o.pending = append(o.pending, pcm...)
+
+	frameLen := o.frameSize * o.channels
+	consumed := 0
+	for len(o.pending)-consumed >= frameLen {
+		if err := o.encodeFrame(o.pending[consumed : consumed+frameLen]); err != nil {
+			return err
+		}
+		consumed += frameLen
+	}
+	o.pending = o.pending[:copy(o.pending, o.pending[consumed:])]
+
+	return nil
+}
+
+func (o *OggOpusWriter) encodeFrame(frame []float32) error {
+	n, err := o.encoder.EncodeFloat32(frame, o.packet)
+	if err != nil {
+		return fmt.Errorf("failed to encode Opus frame: %w", err)
+	}
+
+	// Flush before adding the packet so the final page is never empty
+	if o.stream.Pending() >= pageTargetBytes {
+		if err := o.stream.Flush(0); err != nil {
+			return err
+		}
+	}
+
+	o.granule += uint64(granuleRate * frameDuration / time.Second)
+	return o.stream.WritePacket(o.packet[:n], o.granule)
+}
+
+// Close pads and encodes the final frame and writes the end-of-stream page.
+// It does not close the underlying writer.
+func (o *OggOpusWriter) Close() error {
+	if o.closed {
+		return nil
+	}
+	o.closed = true
+
+	// Keep encoding silence until the encoder lookahead has been flushed so
+	// the last real samples are decodable
+	end := preSkip + o.inputSamples*granuleRate/uint64(o.sampleRate)
+	frameLen := o.frameSize * o.channels
+	for len(o.pending) > 0 || o.granule < end {
+		frame := make([]float32, frameLen)
+		copy(frame, o.pending)
+		o.pending = o.pending[:0]
+
+		if err := o.encodeFrame(frame); err != nil {
+			return err
+		}
+	}
+
+	// The final granule position trims the padding from the end
+	o.stream.granule = end
+	return o.stream.Flush(oggHeaderEOS)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"demovoice/api"
+	"demovoice/storage"
+	"errors"
+	"log"
+	"net/http"
+)
+
+// Error codes reported in DemoMetadata.Error
+const (
+	ErrCodeFileUnreadable     = "file_unreadable"
+	ErrCodeFileTooSmall       = "file_too_small"
+	ErrCodeDecompression      = "decompression_failed"
+	ErrCodeParse              = "parse_failed"
+	ErrCodeParserPanic        = "parser_panic"
+	ErrCodeVoiceFormatChanged = "voice_format_changed" // No longer reported since format changes are resampled; kept for clients matching on it
+	ErrCodeVoiceProcessing    = "voice_processing_failed"
+	ErrCodeOutputWrite        = "output_write_failed"
+	ErrCodeMetadata           = "metadata_failed"
+	ErrCodeDownloadForbidden  = "download_forbidden"
+	ErrCodeDemoNotFound       = "demo_not_found"
+	ErrCodeDownload           = "download_failed"
+	ErrCodeQueueFull          = "queue_full"
+	ErrCodeInternal           = "internal_error"
+)
+
+// processError attaches an error code to an error
+type processError struct {
+	code string
+	err  error
+}
+
+func (e *processError) Error() string { return e.err.Error() }
+func (e *processError) Unwrap() error { return e.err }
+
+// withCode tags an error with a code unless it already carries one
+func withCode(code string, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var coded *processError
+	if errors.As(err, &coded) {
+		return err
+	}
+	return &processError{code: code, err: err}
+}
+
+// processingError converts an error into the form stored in metadata
+func processingError(err error) *storage.ProcessingError {
+	code := ErrCodeInternal
+
+	var coded *processError
+	var status *api.HTTPStatusError
+	switch {
+	case errors.As(err, &status):
+		// Faceit rejecting the download is more specific than its code
+		switch status.StatusCode {
+		case http.StatusUnauthorized, http.StatusForbidden:
+			code = ErrCodeDownloadForbidden
+		case http.StatusNotFound:
+			code = ErrCodeDemoNotFound
+		default:
+			code = ErrCodeDownload
+		}
+	case errors.As(err, &coded):
+		code = coded.code
+	case errors.Is(err, ErrQueueFull):
+		code = ErrCodeQueueFull
+	}
+
+	return &storage.ProcessingError{Code: code, Message: err.Error()}
+}
+
+// demoError returns why a finished demo failed, or nil when it completed
+func demoError(metadata *storage.DemoMetadata) error {
+	if metadata.Status != "failed" {
+		return nil
+	}
+	if metadata.Error == nil {
+		return withCode(ErrCodeInternal, errors.New("processing failed"))
+	}
+	return withCode(metadata.Error.Code, errors.New(metadata.Error.Message))
+}
+
+// markDemoFailed records why a demo failed in its metadata, schedules the
+// metadata for cleanup and notifies progress subscribers and waiting
+// callbacks. It returns the updated metadata, if any exists.
+func markDemoFailed(demoID string, err error) *storage.DemoMetadata {
+	metadata, loadErr := metadataStore.LoadMetadata(demoID)
+	if loadErr == nil {
+		metadata.Status = "failed"
+		metadata.Error = processingError(err)
+		if updateErr := metadataStore.UpdateMetadata(metadata); updateErr != nil {
+			log.Printf("Warning: Failed to record failure of demo %s: %v", demoID, updateErr)
+		}
+		registerTempFile(demoID + ".json")
+	}
+
+	progress.Publish(ProgressEvent{DemoID: demoID, Status: "failed", Error: processingError(err)})
+	notifyWaitingCallbacks(demoID, metadata, err)
+	return metadata
+}
@@ -11,6 +11,7 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -33,7 +34,6 @@ func getExecutableDir() string {
 	return filepath.Dir(ex)
 }
 
-
 // Initialize global clients
 var (
 	faceitClient   *api.FaceitClient
@@ -43,9 +43,13 @@ var (
 	tempFilesMutex sync.RWMutex                 // Protect the tempFiles map
 	uploadedDemos  = make(map[string]time.Time) // Track uploaded demo files
 	demosMutex     sync.RWMutex                 // Protect the uploadedDemos map
+	jobs           *jobQueue                    // Demos waiting to be processed
+	webhookStore   *storage.WebhookStore        // Completion callback deliveries
 )
 
-func init() {
+// setupServer loads configuration, creates the working directories and
+// starts the background cleanup routines used by the web server
+func setupServer() {
 	// Get the directory where the executable is located
 	execDir := getExecutableDir()
 	uploadDir = filepath.Join(execDir, "uploads")
@@ -62,8 +66,18 @@ func init() {
 	}
 
 	// Create required directories
+	sourceDir = filepath.Join(uploadDir, "sources")
 	os.MkdirAll(uploadDir, 0755)
 	os.MkdirAll(outputDir, 0755)
+	os.MkdirAll(sourceDir, 0755)
+
+	if retention := os.Getenv("SOURCE_RETENTION"); retention != "" {
+		if d, err := time.ParseDuration(retention); err == nil {
+			sourceRetention = d
+		} else {
+			log.Printf("Warning: Invalid SOURCE_RETENTION %q, keeping sources for %v", retention, sourceRetention)
+		}
+	}
 
 	// Get Faceit API keys from environment
 	faceitAPIKey := os.Getenv("FACEIT_API_KEY")
@@ -90,6 +104,7 @@ func init() {
 		} else {
 			log.Printf("Redis connected: metadata cache enabled")
 			metadataStore = storage.NewMetadataStoreWithRedis(outputDir, redisCache, tempFileLifetime)
+			usage = redisCache
 		}
 	} else {
 		metadataStore = storage.NewMetadataStore(outputDir)
@@ -99,6 +114,43 @@ func init() {
 	// This prevents deleting files if server restarts
 	// cleanExistingFiles()
 
+	// Webhook deliveries contain secrets, so they are kept out of the served output directory
+	store, err := storage.NewWebhookStore(filepath.Join(execDir, "webhooks"))
+	if err != nil {
+		log.Fatalf("Failed to create webhook directory: %v", err)
+	}
+	webhookStore = store
+	go startWebhookCleanup()
+
+	// API keys are secrets too
+	keys, err := storage.NewAPIKeyStore(filepath.Join(execDir, "keys"))
+	if err != nil {
+		log.Fatalf("Failed to load API keys: %v", err)
+	}
+	apiKeys = keys
+	log.Printf("API keys: %d active", apiKeys.Len())
+
+	// Outputs are only served through signed, expiring URLs
+	if err := loadOutputURLKey(filepath.Join(execDir, "keys", "output_url.secret")); err != nil {
+		log.Fatalf("Failed to create output URL signing key: %v", err)
+	}
+	setOutputURLTTL()
+	setMaxUploadSize()
+
+	// Partial resumable uploads survive restarts so clients can resume them
+	uploads, err := storage.NewUploadStore(filepath.Join(uploadDir, "partial"))
+	if err != nil {
+		log.Fatalf("Failed to create resumable upload directory: %v", err)
+	}
+	uploadStore = uploads
+
+	// Start the processing workers
+	jobs = newJobQueue(
+		envInt("PROCESSING_WORKERS", defaultProcessingWorkers),
+		envInt("PROCESSING_BACKLOG", defaultProcessingBacklog),
+		runProcessingJob,
+	)
+
 	// Start background cleanup routine for temporary files
 	go startTempFileCleanup()
 
@@ -107,6 +159,16 @@ func init() {
 }
 
 func main() {
+	// Offline extraction without the web server
+	if len(os.Args) > 1 && os.Args[1] == "extract" {
+		os.Exit(runExtract(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "keys" {
+		os.Exit(runKeys(os.Args[2:]))
+	}
+
+	setupServer()
+
 	// Handle routes (removed password auth)
 	http.HandleFunc("/", handleHome)
 	http.HandleFunc("/reset", handleReset)
@@ -116,7 +178,17 @@ func main() {
 	http.HandleFunc("/faceit/player", handleFaceitPlayer)
 	http.HandleFunc("/faceit/match", handleFaceitMatch)
 	http.HandleFunc("/status", handleStatus)
-	http.Handle("/output/", http.StripPrefix("/output/", corsHandler(http.FileServer(http.Dir(outputDir)))))
+	http.HandleFunc("/segments", handleSegments)
+	http.HandleFunc("/events", handleEvents)
+	http.HandleFunc("GET /api/webhooks", handleWebhooks)
+	http.HandleFunc("GET /api/webhooks/{id}", handleWebhook)
+	http.HandleFunc("POST /api/webhooks/{id}/replay", handleWebhookReplay)
+	http.HandleFunc("POST /api/demos/{id}/reprocess", handleReprocess)
+	registerAPIv1Routes()
+	registerAPIKeyRoutes()
+	registerResumableUploadRoutes()
+	http.HandleFunc("GET /api/openapi.json", handleOpenAPI)
+	http.Handle("/output/", corsHandler(http.HandlerFunc(handleOutput)))
 	http.Handle("/icons/", http.StripPrefix("/icons/", http.FileServer(http.Dir("./icons"))))
 
 	// Configure server with extended timeouts for large file uploads
@@ -137,6 +209,9 @@ func handleFaceitPlayer(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Steam ID is required", http.StatusBadRequest)
 		return
 	}
+	if !authorizeWebRequest(w, r) {
+		return
+	}
 
 	// Use our new FaceitClient
 	response, err := faceitClient.GetPlayerInfo(steamID)
@@ -155,6 +230,9 @@ func handleFaceitMatch(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Match ID is required", http.StatusBadRequest)
 		return
 	}
+	if !authorizeWebRequest(w, r) {
+		return
+	}
 
 	// Get match data from Faceit API
 	response, err := faceitClient.GetMatchData(matchID)
@@ -169,18 +247,27 @@ func handleFaceitMatch(w http.ResponseWriter, r *http.Request) {
 
 // StatusResponse contains the current status of a demo
 type StatusResponse struct {
-	Status  string           `json:"status"`
-	DemoID  string           `json:"demo_id"`
-	MatchID string           `json:"match_id"`
-	Players []api.PlayerInfo `json:"players"`
-	ChatLog string           `json:"chat_log,omitempty"`
+	Status        string                   `json:"status"`
+	QueuePosition int                      `json:"queue_position,omitempty"` // Position in the processing queue while queued
+	DemoID        string                   `json:"demo_id"`
+	MatchID       string                   `json:"match_id"`
+	Players       []api.PlayerInfo         `json:"players"`
+	ChatLog       string                   `json:"chat_log,omitempty"`
+	Chat          []storage.ChatMessage    `json:"chat,omitempty"` // Structured chat log
+	Segments      string                   `json:"segments,omitempty"`
+	Mixdown       string                   `json:"mixdown,omitempty"`
+	Rounds        []storage.RoundInfo      `json:"rounds,omitempty"`
+	SubtitlesVTT  string                   `json:"subtitles_vtt,omitempty"` // WebVTT track of who is speaking when
+	SubtitlesSRT  string                   `json:"subtitles_srt,omitempty"`
+	Error         *storage.ProcessingError `json:"error,omitempty"` // Why processing failed
+	URLs          map[string]string        `json:"urls,omitempty"`  // Signed download URLs of the output files, by filename
 }
 
 func handleStatus(w http.ResponseWriter, r *http.Request) {
 	// Add CORS headers for API access
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-API-Key")
 
 	if r.Method == "OPTIONS" {
 		w.WriteHeader(http.StatusOK)
@@ -199,6 +286,10 @@ func handleStatus(w http.ResponseWriter, r *http.Request) {
 		}
 		demoID = demoCookie.Value
 	}
+	signed, ok := authorizeDemoRequest(w, r, demoID)
+	if !ok {
+		return
+	}
 
 	metadata, err := metadataStore.LoadMetadata(demoID)
 	if err != nil {
@@ -211,38 +302,224 @@ func handleStatus(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Return the structured chat log so API clients don't need to parse the text file
+	var chat []storage.ChatMessage
+	if metadata.ChatLogJSON != "" {
+		chat, err = metadataStore.LoadChatMessages(metadata.OutputPrefix())
+		if err != nil {
+			log.Printf("Warning: Could not load structured chat log for %s: %v", demoID, err)
+		}
+	}
+
 	w.Header().Set("Content-Type", "application/json")
+	var queuePosition int
+	if metadata.Status == "queued" {
+		queuePosition = jobs.Position(demoID)
+	}
+
+	// Download links are only handed to callers with a key or access token
+	var urls map[string]string
+	if signed {
+		urls = outputURLs(metadata)
+	}
+
 	json.NewEncoder(w).Encode(StatusResponse{
-		Status:  metadata.Status,
-		DemoID:  metadata.DemoID,
-		MatchID: metadata.MatchID,
-		Players: metadata.Players,
-		ChatLog: metadata.ChatLog,
+		Status:        metadata.Status,
+		QueuePosition: queuePosition,
+		DemoID:        metadata.DemoID,
+		MatchID:       metadata.MatchID,
+		Players:       metadata.Players,
+		ChatLog:       metadata.ChatLog,
+		Chat:          chat,
+		Segments:      metadata.Segments,
+		Mixdown:       metadata.Mixdown,
+		Rounds:        metadata.Rounds,
+		SubtitlesVTT:  metadata.SubtitlesVTT,
+		SubtitlesSRT:  metadata.SubtitlesSRT,
+		Error:         metadata.Error,
+		URLs:          urls,
 	})
 }
 
+// handleEvents streams processing progress of a demo as Server-Sent Events.
+// The stream ends after the demo has completed or failed.
+func handleEvents(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	demoID := r.URL.Query().Get("demo_id")
+	if demoID == "" {
+		demoID = getCurrentDemoID(r)
+	}
+	if demoID == "" {
+		http.Error(w, "Demo ID is required", http.StatusBadRequest)
+		return
+	}
+	if _, ok := authorizeDemoRequest(w, r, demoID); !ok {
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	// Subscribe before reading the current state so no transition is missed
+	updates, latest, unsubscribe := progress.Subscribe(demoID)
+	defer unsubscribe()
+
+	current := latest
+	if current == nil {
+		metadata, err := metadataStore.LoadMetadata(demoID)
+		if err != nil {
+			http.Error(w, "Demo not found", http.StatusNotFound)
+			return
+		}
+		current = &ProgressEvent{DemoID: demoID, Status: progressStage(metadata.Status)}
+	}
+	if current.Status == "queued" && current.QueuePosition == 0 {
+		current.QueuePosition = jobs.Position(demoID)
+	}
+
+	// Streams outlive the server's write timeout
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	send := func(event ProgressEvent) bool {
+		data, _ := json.Marshal(event)
+		if _, err := fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
+			return false
+		}
+		flusher.Flush()
+		return true
+	}
+
+	if !send(*current) || current.Done() {
+		return
+	}
+
+	keepAlive := time.NewTicker(15 * time.Second)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event := <-updates:
+			if !send(event) || event.Done() {
+				return
+			}
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// handleSegments returns the voice segment index of a demo, optionally
+// filtered to one player (?steamid=) and one round (?round=)
+func handleSegments(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w)
+
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	query := r.URL.Query()
+	demoID := query.Get("demo_id")
+	if demoID == "" {
+		demoID = getCurrentDemoID(r)
+	}
+	if demoID == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Demo ID is required"})
+		return
+	}
+	if _, ok := authorizeDemoRequest(w, r, demoID); !ok {
+		return
+	}
+
+	round := 0
+	if roundParam := query.Get("round"); roundParam != "" {
+		parsed, err := strconv.Atoi(roundParam)
+		if err != nil || parsed < 1 {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Invalid round number"})
+			return
+		}
+		round = parsed
+	}
+
+	outputID := demoID
+	if metadata, err := metadataStore.LoadMetadata(demoID); err == nil {
+		outputID = metadata.OutputPrefix()
+	}
+
+	index, err := metadataStore.LoadVoiceIndex(outputID)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Segment index not found"})
+		return
+	}
+
+	steamID := query.Get("steamid")
+	filtered := make([]storage.PlayerVoiceIndex, 0, len(index.Players))
+	for _, player := range index.Players {
+		if steamID != "" && player.SteamID != steamID {
+			continue
+		}
+
+		if round != 0 {
+			var segments []storage.VoiceSegment
+			for _, segment := range player.Segments {
+				if segment.Round == round {
+					segments = append(segments, segment)
+				}
+			}
+			player.Segments = segments
+		}
+
+		filtered = append(filtered, player)
+	}
+	index.Players = filtered
+
+	json.NewEncoder(w).Encode(index)
+}
+
 func handleReset(w http.ResponseWriter, r *http.Request) {
 	http.SetCookie(w, &http.Cookie{
-		Name:    "current_demo_id",
-		Value:   "",
-		Path:    "/",
-		MaxAge:  -1,
+		Name:   "current_demo_id",
+		Value:  "",
+		Path:   "/",
+		MaxAge: -1,
+	})
+	http.SetCookie(w, &http.Cookie{
+		Name:   demoAccessCookie,
+		Value:  "",
+		Path:   "/",
+		MaxAge: -1,
 	})
 	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
 
 func handleHome(w http.ResponseWriter, r *http.Request) {
-	// Check if demo_id is in the URL (e.g., /?demo_id=123)
+	// Check if demo_id is in the URL (e.g., /?demo_id=123&access=<token>)
 	queryDemoID := r.URL.Query().Get("demo_id")
 	if queryDemoID != "" {
-		// Set the session cookie automatically
-		http.SetCookie(w, &http.Cookie{
-			Name:     "current_demo_id",
-			Value:    queryDemoID,
-			Path:     "/",
-			MaxAge:   3600 * 2, // 2 hours
-			HttpOnly: false,    // Set to false if your JS needs to read it
-		})
+		// Open the shared demo when the link carries its access token
+		if hasDemoAccess(r, queryDemoID) {
+			setCurrentDemo(w, queryDemoID)
+		} else {
+			log.Printf("⚠️  Ignoring shared link to demo %s without a valid access token", queryDemoID)
+		}
 
 		// Redirect to / to clean up the URL
 		http.Redirect(w, r, "/", http.StatusSeeOther)
@@ -255,8 +532,10 @@ func handleHome(w http.ResponseWriter, r *http.Request) {
 	var currentDemo *storage.DemoMetadata
 	var playersJSON string
 	var cachedMatchData string
+	var fileURLs map[string]string
+	var accessToken string
 
-	if currentDemoID != "" {
+	if hasDemoAccess(r, currentDemoID) {
 		// Try to load metadata for this demo
 		metadata, err := metadataStore.LoadMetadata(currentDemoID)
 		if err == nil {
@@ -266,6 +545,8 @@ func handleHome(w http.ResponseWriter, r *http.Request) {
 			playersJSON = string(playersBytes)
 			// Pass cached match data if available
 			cachedMatchData = metadata.MatchDataJSON
+			fileURLs = outputURLs(metadata)
+			accessToken = demoAccessToken(currentDemoID)
 		}
 	}
 
@@ -277,17 +558,43 @@ func handleHome(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	fileURLsJSON, _ := json.Marshal(fileURLs)
+
 	tmpl.Execute(w, struct {
 		CurrentDemo     *storage.DemoMetadata
 		PlayersJSON     string
 		CachedMatchData string
+		FileURLs        map[string]string
+		FileURLsJSON    string
+		AccessToken     string
 	}{
 		CurrentDemo:     currentDemo,
 		PlayersJSON:     playersJSON,
 		CachedMatchData: cachedMatchData,
+		FileURLs:        fileURLs,
+		FileURLsJSON:    string(fileURLsJSON),
+		AccessToken:     accessToken,
 	})
 }
 
+// processOptionsFromRequest reads the extraction options shared by the upload endpoints
+// (?chat_only=true, ?tick_aligned=true, ?mixdown=true, ?split_rounds=true, ?format=wav16)
+func processOptionsFromRequest(r *http.Request) (ProcessOptions, error) {
+	query := r.URL.Query()
+	format, err := ParseOutputFormat(query.Get("format"))
+	if err != nil {
+		return ProcessOptions{}, err
+	}
+
+	return ProcessOptions{
+		ChatOnly:    query.Get("chat_only") == "true",
+		TickAligned: query.Get("tick_aligned") == "true",
+		Mixdown:     query.Get("mixdown") == "true",
+		SplitRounds: query.Get("split_rounds") == "true",
+		Format:      format,
+	}, nil
+}
+
 // Helper to get the demo ID from the session cookie
 func getCurrentDemoID(r *http.Request) string {
 	demoCookie, err := r.Cookie("current_demo_id")
@@ -304,168 +611,137 @@ func handleUpload(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Check if chat-only mode is requested
-	chatOnly := r.URL.Query().Get("chat_only") == "true"
-	if chatOnly {
+	opts, err := processOptionsFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if opts.ChatOnly {
 		log.Printf("📋 Web upload: Chat-only mode requested")
 	}
 
+	// Reject before receiving the file when there is no room to process it
+	if jobs.Full() {
+		http.Error(w, ErrQueueFull.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
 	// Parse the uploaded file
-	file, header, err := r.FormFile("demo")
+	file, filename, err := formDemoFile(w, r)
+	if status := uploadErrorStatus(err, 0); status != 0 {
+		http.Error(w, err.Error(), status)
+		return
+	}
 	if err != nil {
 		http.Error(w, "Error receiving file", http.StatusBadRequest)
 		return
 	}
-	defer file.Close()
 
 	// Extract match ID from filename for instant team loading
-	matchID := storage.ExtractMatchIDFromFilename(header.Filename)
-
-	// Check if we already have this demo processed (cache lookup)
-	if matchID != "" {
-		existingDemo, err := metadataStore.FindDemoByMatchID(matchID, tempFileLifetime)
-		if err == nil && existingDemo != nil {
-			log.Printf("🎯 Cache HIT! Reusing existing demo %s for match %s", existingDemo.DemoID, matchID)
-
-			// Set cookie to existing demo
-			http.SetCookie(w, &http.Cookie{
-				Name:    "current_demo_id",
-				Value:   existingDemo.DemoID,
-				Path:    "/",
-				Expires: time.Now().Add(24 * time.Hour),
-			})
-
-			// Redirect immediately - no need to reprocess!
-			http.Redirect(w, r, "/", http.StatusSeeOther)
-			return
-		}
-	}
+	matchID := storage.ExtractMatchIDFromFilename(filename)
 
-	// Create a unique ID for this demo upload (cache miss - need to process)
-	demoID := fmt.Sprintf("demo_%d", time.Now().UnixNano())
-	var matchDataJSON string
+	job := &processingJob{Filename: filepath.Base(filename), MatchID: matchID, Options: opts}
 
 	// If we found a match ID, prefetch match data for faster UI loading
 	if matchID != "" {
-		log.Printf("Cache MISS - Processing new demo for match ID: %s", matchID)
+		log.Printf("Prefetching match data for match ID: %s", matchID)
 		matchData, err := faceitClient.GetMatchData(matchID)
 		if err != nil {
 			log.Printf("Warning: Could not prefetch match data: %v", err)
 		} else {
-			matchDataBytes, _ := json.Marshal(matchData)
-			matchDataJSON = string(matchDataBytes)
+			job.MatchData = matchData
 			log.Printf("Prefetched match data for faster loading")
 		}
 	}
 
-	// Create temporary file for processing
-	tempPath := filepath.Join(uploadDir, header.Filename)
-	tempFile, err := os.Create(tempPath)
-	if err != nil {
+	metadata, _, err := queueUploadedDemo(file, job)
+	if metadata == nil {
+		if status := uploadErrorStatus(err, 0); status != 0 {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		log.Printf("Error saving upload %s: %v", job.Filename, err)
 		http.Error(w, "Error saving file", http.StatusInternalServerError)
 		return
 	}
-	defer tempFile.Close()
 
-	// Copy uploaded file to temporary location
-	_, err = io.Copy(tempFile, file)
+	// Set cookie immediately
+	setCurrentDemo(w, metadata.DemoID)
+
 	if err != nil {
-		http.Error(w, "Error saving file", http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
 		return
 	}
 
-	// Create initial metadata with "processing" status and cached match data
-	initialMetadata := &storage.DemoMetadata{
-		DemoID:        demoID,
-		Filename:      header.Filename,
-		MatchID:       matchID,
-		Status:        "processing",
-		UploadTime:    time.Now(),
-		Players:       []api.PlayerInfo{},
-		MatchDataJSON: matchDataJSON,
-	}
-	metadataStore.UpdateMetadata(initialMetadata)
-	// Also register the metadata file so it gets cleaned up
-	registerTempFile(demoID + ".json")
+	// Redirect back to home page immediately
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
 
-	// Set cookie immediately
-	http.SetCookie(w, &http.Cookie{
-		Name:    "current_demo_id",
-		Value:   demoID,
-		Path:    "/",
-		Expires: time.Now().Add(24 * time.Hour),
-	})
+// queueUploadedDemo saves an uploaded demo under a new demo ID and queues it
+// for processing. The metadata is nil when the file was rejected or could not
+// be saved; a queueing error still returns the (failed) demo's metadata.
+// When the same demo was already uploaded, its metadata is returned instead
+// and job.DemoID stays empty.
+func queueUploadedDemo(file io.Reader, job *processingJob) (*storage.DemoMetadata, int, error) {
+	path, hash, err := saveDemoUpload(file)
+	if err != nil {
+		return nil, 0, err
+	}
+	job.DemoPath = path
+	job.ContentHash = hash
 
-	// Process in background
-	go func() {
-		// Register uploaded demo for cleanup
-		registerUploadedDemo(header.Filename)
+	return queueStoredDemo(job)
+}
 
-		// Process the demo file
-		playerTeams, err := ProcessDemo(tempPath, demoID, chatOnly)
-		if err != nil {
-			log.Printf("Error processing demo %s: %v", demoID, err)
-			// Update status to failed
-			initialMetadata, _ := metadataStore.LoadMetadata(demoID)
-			if initialMetadata != nil {
-				initialMetadata.Status = "failed"
-				metadataStore.UpdateMetadata(initialMetadata)
+// contentHashMutex makes finding a demo by content hash and creating a new
+// one atomic, so concurrent uploads of the same demo share one job
+var contentHashMutex sync.Mutex
+
+// queueStoredDemo creates a demo for a file that is already at job.DemoPath
+// and queues it for processing. A demo with the same job.ContentHash and
+// options that is queued, processing or recently completed is returned
+// instead, the file is deleted and job.Callback is notified when that demo
+// finishes.
+func queueStoredDemo(job *processingJob) (*storage.DemoMetadata, int, error) {
+	if job.ContentHash != "" {
+		contentHashMutex.Lock()
+		defer contentHashMutex.Unlock()
+
+		if existing, _ := metadataStore.FindDemoByContentHash(job.ContentHash, dedupOptions(job.Options), tempFileLifetime); existing != nil {
+			log.Printf("🎯 Cache HIT! %s has the same content as demo %s", job.Filename, existing.DemoID)
+			os.Remove(job.DemoPath)
+			if job.Callback != nil {
+				notifyWhenFinished(job.Callback, existing)
 			}
-			return
+			return existing, 0, nil
 		}
+	}
 
-		// Save demo metadata (scans files and populates players)
-		// This will set Status to "completed" as per our change in metadata.go
-		metadata, err := metadataStore.SaveMetadata(demoID, header.Filename)
-		if err != nil {
-			log.Printf("Warning: Failed to save metadata: %v", err)
-		} else {
-			// Save team information now that metadata exists
-			saveTeamMetadata(demoID, playerTeams)
-
-			// Try to fetch match data first if we have a match ID
-			var matchData *api.MatchResponse
-			if metadata.MatchID != "" {
-				log.Printf("Fetching match data for uploaded demo with match ID: %s", metadata.MatchID)
-				md, err := faceitClient.GetMatchData(metadata.MatchID)
-				if err == nil {
-					matchData = md
-					// Update MatchDataJSON
-					matchDataBytes, _ := json.Marshal(matchData)
-					metadata.MatchDataJSON = string(matchDataBytes)
-					log.Printf("Successfully enriched uploaded demo with match data")
-
-					// Use match data to enrich players
-					metadata.Players = faceitClient.EnrichPlayersFromMatch(metadata.Players, matchData)
-				} else {
-					log.Printf("Warning: Failed to fetch match data for uploaded demo: %v", err)
-				}
-			}
-
-			// Enrich player data with Faceit information (nickname, ELO, level)
-			// Fallback to individual API calls if nickname is still missing
-			for i := range metadata.Players {
-				if metadata.Players[i].Nickname == "" {
-					if err := faceitClient.EnrichPlayerInfo(&metadata.Players[i]); err != nil {
-						log.Printf("Warning: Failed to enrich player %s: %v", metadata.Players[i].SteamID, err)
-					}
-				}
-			}
-
-			// Save enriched metadata
-			metadataStore.UpdateMetadata(metadata)
+	// Create a unique ID for this demo upload
+	job.DemoID = fmt.Sprintf("demo_%d", time.Now().UnixNano())
 
-			// Register all generated audio files as temporary
-			for _, player := range metadata.Players {
-				registerTempFile(player.AudioFile)
-			}
-		}
+	// Create initial metadata with cached match data for faster UI loading
+	initialMetadata := &storage.DemoMetadata{
+		DemoID:      job.DemoID,
+		Filename:    job.Filename,
+		MatchID:     job.MatchID,
+		Status:      "queued",
+		UploadTime:  time.Now(),
+		Players:     []api.PlayerInfo{},
+		ContentHash: job.ContentHash,
+		Options:     dedupOptions(job.Options),
+	}
+	if job.MatchData != nil {
+		matchDataBytes, _ := json.Marshal(job.MatchData)
+		initialMetadata.MatchDataJSON = string(matchDataBytes)
+	}
+	metadataStore.UpdateMetadata(initialMetadata)
 
-		// Clean up uploaded file
-		os.Remove(tempPath)
-	}()
+	log.Printf("📥 Upload received for processing: %s -> %s", job.Filename, job.DemoID)
 
-	// Redirect back to home page immediately
-	http.Redirect(w, r, "/", http.StatusSeeOther)
+	// Queue for background processing
+	position, err := enqueueJob(initialMetadata, job)
+	return initialMetadata, position, err
 }
 
 // corsHandler wraps a handler to add CORS headers
@@ -473,7 +749,8 @@ func corsHandler(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, Range")
+		w.Header().Set("Access-Control-Expose-Headers", "Accept-Ranges, Content-Length, Content-Range")
 
 		if r.Method == "OPTIONS" {
 			w.WriteHeader(http.StatusOK)
@@ -493,11 +770,17 @@ func setCORSHeaders(w http.ResponseWriter) {
 
 // APIUploadResponse is the JSON response for API uploads
 type APIUploadResponse struct {
-	Success  bool   `json:"success"`
-	DemoID   string `json:"demo_id,omitempty"`
-	Status   string `json:"status,omitempty"`
-	Error    string `json:"error,omitempty"`
-	ChatOnly bool   `json:"chat_only,omitempty"`
+	Success       bool   `json:"success"`
+	DemoID        string `json:"demo_id,omitempty"`
+	Status        string `json:"status,omitempty"`
+	QueuePosition int    `json:"queue_position,omitempty"`
+	Error         string `json:"error,omitempty"`
+	ChatOnly      bool   `json:"chat_only,omitempty"`
+	TickAligned   bool   `json:"tick_aligned,omitempty"`
+	Mixdown       bool   `json:"mixdown,omitempty"`
+	SplitRounds   bool   `json:"split_rounds,omitempty"`
+	Format        string `json:"format,omitempty"`
+	AccessToken   string `json:"access_token,omitempty"` // Reads the demo through /status and /events without a key
 }
 
 // handleAPIUpload handles demo uploads via JSON API (for external services like faceitgpt.com)
@@ -518,138 +801,123 @@ func handleAPIUpload(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Verify API key
-	expectedAPIKey := os.Getenv("API_KEY")
-	if expectedAPIKey != "" {
-		providedKey := r.Header.Get("X-API-Key")
-		if providedKey != expectedAPIKey {
-			log.Printf("⚠️  API Upload rejected: Invalid or missing API key")
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusUnauthorized)
-			json.NewEncoder(w).Encode(APIUploadResponse{Success: false, Error: "Unauthorized: Invalid API key"})
-			return
-		}
+	key, ok := authorizeAPIRequest(w, r, storage.ScopeUpload)
+	if !ok {
+		return
+	}
+
+	// Reject before receiving the file when there is no room to process it
+	if jobs.Full() {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(APIUploadResponse{Success: false, Error: ErrQueueFull.Error()})
+		return
 	}
 
 	// Parse the uploaded file
-	file, header, err := r.FormFile("demo")
+	file, filename, err := formDemoFile(w, r)
 	if err != nil {
 		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
+		w.WriteHeader(uploadErrorStatus(err, http.StatusBadRequest))
 		json.NewEncoder(w).Encode(APIUploadResponse{Success: false, Error: "Error receiving file: " + err.Error()})
 		return
 	}
-	defer file.Close()
 
-	log.Printf("📥 API Upload received: %s (size: %d bytes)", header.Filename, header.Size)
+	log.Printf("📥 API Upload receiving: %s", filename)
 
 	// Check if chat-only mode is requested
-	chatOnly := r.URL.Query().Get("chat_only") == "true"
-	if chatOnly {
+	opts, err := processOptionsFromRequest(r)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(APIUploadResponse{Success: false, Error: err.Error()})
+		return
+	}
+	if opts.ChatOnly {
 		log.Printf("📋 Chat-only mode requested - skipping voice processing")
 	}
 
-	// Extract match ID from filename for caching
-	matchID := storage.ExtractMatchIDFromFilename(header.Filename)
-
-	// Check cache
-	if matchID != "" {
-		existingDemo, err := metadataStore.FindDemoByMatchID(matchID, tempFileLifetime)
-		if err == nil && existingDemo != nil {
-			log.Printf("🎯 API Cache HIT! Reusing existing demo %s for match %s", existingDemo.DemoID, matchID)
-			w.Header().Set("Content-Type", "application/json")
-			json.NewEncoder(w).Encode(APIUploadResponse{
-				Success: true,
-				DemoID:  existingDemo.DemoID,
-				Status:  existingDemo.Status,
-			})
-			return
+	// Save the file first: form fields sent after it are read once it ends
+	path, hash, err := saveDemoUpload(file)
+	if err != nil {
+		message := "Error saving file"
+		status := uploadErrorStatus(err, http.StatusInternalServerError)
+		if status == http.StatusInternalServerError {
+			log.Printf("Error saving upload %s: %v", filename, err)
+		} else {
+			message = err.Error()
 		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(APIUploadResponse{Success: false, Error: message})
+		return
 	}
 
-	// Create a unique ID for this demo upload
-	demoID := fmt.Sprintf("demo_%d", time.Now().UnixNano())
-
-	// Create temporary file for processing
-	tempPath := filepath.Join(uploadDir, header.Filename)
-	tempFile, err := os.Create(tempPath)
+	// Optional completion webhook
+	callback, err := webhookTargetFromRequest(r)
 	if err != nil {
+		os.Remove(path)
 		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(APIUploadResponse{Success: false, Error: "Error saving file"})
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(APIUploadResponse{Success: false, Error: err.Error()})
 		return
 	}
-	defer tempFile.Close()
 
-	// Copy uploaded file to temporary location
-	_, err = io.Copy(tempFile, file)
-	if err != nil {
+	if err := chargeDemoQuota(key); err != nil {
+		os.Remove(path)
 		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(APIUploadResponse{Success: false, Error: "Error saving file"})
+		w.WriteHeader(http.StatusTooManyRequests)
+		json.NewEncoder(w).Encode(APIUploadResponse{Success: false, Error: err.Error()})
 		return
 	}
 
-	// Create initial metadata with "processing" status
-	initialMetadata := &storage.DemoMetadata{
-		DemoID:     demoID,
-		Filename:   header.Filename,
-		MatchID:    matchID,
-		Status:     "processing",
-		UploadTime: time.Now(),
-		Players:    []api.PlayerInfo{},
+	// The filename only names the match; an existing demo is reused after the
+	// upload's content hash matches it
+	job := &processingJob{
+		DemoPath:    path,
+		Filename:    filepath.Base(filename),
+		MatchID:     storage.ExtractMatchIDFromFilename(filename),
+		Options:     opts,
+		Callback:    callback,
+		ContentHash: hash,
 	}
-	metadataStore.UpdateMetadata(initialMetadata)
-	registerTempFile(demoID + ".json")
-
-	log.Printf("📥 API Upload started processing: %s -> %s", header.Filename, demoID)
-
-	// Process in background
-	go func() {
-		registerUploadedDemo(header.Filename)
-
-		// Process the demo file
-		playerTeams, err := ProcessDemo(tempPath, demoID, chatOnly)
-		if err != nil {
-			log.Printf("❌ API Upload error processing demo %s: %v", demoID, err)
-			initialMetadata, _ := metadataStore.LoadMetadata(demoID)
-			if initialMetadata != nil {
-				initialMetadata.Status = "failed"
-				metadataStore.UpdateMetadata(initialMetadata)
-			}
-			return
-		}
-
-		// Save demo metadata
-		metadata, err := metadataStore.SaveMetadata(demoID, header.Filename)
-		if err != nil {
-			log.Printf("Warning: Failed to save metadata: %v", err)
-		} else {
-			saveTeamMetadata(demoID, playerTeams)
 
-			// Enrich player data
-			for i := range metadata.Players {
-				if metadata.Players[i].Nickname == "" {
-					faceitClient.EnrichPlayerInfo(&metadata.Players[i])
-				}
-			}
-			metadataStore.UpdateMetadata(metadata)
-
-			for _, player := range metadata.Players {
-				registerTempFile(player.AudioFile)
-			}
-		}
+	// Queue for background processing
+	metadata, position, err := queueStoredDemo(job)
+	if err != nil {
+		refundDemoQuota(key)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(APIUploadResponse{Success: false, Error: err.Error()})
+		return
+	}
 
-		log.Printf("✅ API Upload completed: %s", demoID)
-		os.Remove(tempPath)
-	}()
+	// The same demo was already uploaded
+	if metadata.DemoID != job.DemoID {
+		refundDemoQuota(key)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(APIUploadResponse{
+			Success:     true,
+			DemoID:      metadata.DemoID,
+			Status:      metadata.Status,
+			AccessToken: demoAccessToken(metadata.DemoID),
+		})
+		return
+	}
 
 	// Return immediately with demo_id for status polling
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(APIUploadResponse{
-		Success:  true,
-		DemoID:   demoID,
-		Status:   "processing",
-		ChatOnly: chatOnly,
+		Success:       true,
+		DemoID:        metadata.DemoID,
+		Status:        "queued",
+		QueuePosition: position,
+		ChatOnly:      opts.ChatOnly,
+		TickAligned:   opts.TickAligned,
+		Mixdown:       opts.Mixdown,
+		SplitRounds:   opts.SplitRounds,
+		Format:        string(opts.Format),
+		AccessToken:   demoAccessToken(metadata.DemoID),
 	})
 }
 
@@ -660,11 +928,21 @@ func handleDownloadFromURL(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Check if chat-only mode is requested
-	chatOnly := r.URL.Query().Get("chat_only") == "true"
-	if chatOnly {
+	opts, err := processOptionsFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if opts.ChatOnly {
 		log.Printf("📋 URL download: Chat-only mode requested")
 	}
 
+	// Reject before downloading when there is no room to process the demo
+	if jobs.Full() {
+		http.Error(w, ErrQueueFull.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
 	// Get the matchroom URL from form
 	matchroomURL := r.FormValue("matchroom_url")
 	if matchroomURL == "" {
@@ -680,17 +958,12 @@ func handleDownloadFromURL(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Check if we already have this demo processed (cache lookup)
-	existingDemo, err := metadataStore.FindDemoByMatchID(matchID, tempFileLifetime)
+	existingDemo, err := metadataStore.FindDemoByMatchID(matchID, dedupOptions(opts), tempFileLifetime)
 	if err == nil && existingDemo != nil {
 		log.Printf("🎯 Cache HIT! Reusing existing demo %s for match %s", existingDemo.DemoID, matchID)
 
 		// Set cookie to existing demo
-		http.SetCookie(w, &http.Cookie{
-			Name:    "current_demo_id",
-			Value:   existingDemo.DemoID,
-			Path:    "/",
-			Expires: time.Now().Add(24 * time.Hour),
-		})
+		setCurrentDemo(w, existingDemo.DemoID)
 
 		// Redirect immediately - no need to reprocess!
 		http.Redirect(w, r, "/", http.StatusSeeOther)
@@ -699,114 +972,74 @@ func handleDownloadFromURL(w http.ResponseWriter, r *http.Request) {
 
 	log.Printf("Cache MISS - Starting async download for match ID: %s", matchID)
 
+	metadata := startDemoDownload(&processingJob{MatchID: matchID, Options: opts})
+
+	// Set cookie immediately
+	setCurrentDemo(w, metadata.DemoID)
+
+	// Redirect back to home page immediately
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// startDemoDownload creates a new demo for a Faceit match and downloads it
+// in the background, queueing it for processing once it is on disk
+func startDemoDownload(job *processingJob) *storage.DemoMetadata {
 	// Create a unique demo ID
-	demoID := fmt.Sprintf("demo_%d", time.Now().UnixNano())
-	demoFilename := fmt.Sprintf("%s.dem.zst", matchID)
+	job.DemoID = fmt.Sprintf("demo_%d", time.Now().UnixNano())
+	job.Filename = fmt.Sprintf("%s.dem.zst", job.MatchID)
+	job.DemoPath = newUploadPath(".dem.zst")
 
 	// Fetch match data immediately for faster UI loading
 	var matchDataJSON string
-	matchData, err := faceitClient.GetMatchData(matchID)
+	matchData, err := faceitClient.GetMatchData(job.MatchID)
 	if err != nil {
 		log.Printf("Warning: Could not prefetch match data: %v", err)
 	} else {
 		matchDataBytes, _ := json.Marshal(matchData)
 		matchDataJSON = string(matchDataBytes)
+		job.MatchData = matchData
 		log.Printf("Prefetched match data for faster loading")
 	}
 
-	// Create initial metadata with "processing" status and cached match data
+	// Create initial metadata with "downloading" status and cached match data
 	initialMetadata := &storage.DemoMetadata{
-		DemoID:        demoID,
-		MatchID:       matchID,
-		Filename:      demoFilename,
-		Status:        "processing",
+		DemoID:        job.DemoID,
+		MatchID:       job.MatchID,
+		Filename:      job.Filename,
+		Status:        "downloading",
 		UploadTime:    time.Now(),
 		Players:       []api.PlayerInfo{},
 		MatchDataJSON: matchDataJSON,
 	}
 	metadataStore.UpdateMetadata(initialMetadata)
-	registerTempFile(demoID + ".json")
-
-	// Set cookie immediately
-	http.SetCookie(w, &http.Cookie{
-		Name:    "current_demo_id",
-		Value:   demoID,
-		Path:    "/",
-		Expires: time.Now().Add(24 * time.Hour),
-	})
 
 	// Process in background
+	progress.PublishStatus(job.DemoID, "downloading")
 	go func() {
 		// Download the demo file
-		demoPath := filepath.Join(uploadDir, demoFilename)
-		err := faceitClient.DownloadDemo(matchID, demoPath)
-		if err != nil {
-			log.Printf("Error downloading demo %s: %v", matchID, err)
-			// Update status to failed
-			initialMetadata.Status = "failed"
-			metadataStore.UpdateMetadata(initialMetadata)
-			return
-		}
-
-		log.Printf("Demo downloaded successfully to: %s", demoPath)
-
-		// Register the downloaded demo for cleanup
-		registerUploadedDemo(demoFilename)
-
-		// Process the demo file
-		playerTeams, err := ProcessDemo(demoPath, demoID, chatOnly)
+		err := faceitClient.DownloadDemo(job.MatchID, job.DemoPath)
 		if err != nil {
-			log.Printf("Error processing demo: %v", err)
-			// Update status to failed
-			initialMetadata.Status = "failed"
-			metadataStore.UpdateMetadata(initialMetadata)
-			// Clean up the downloaded file
-			os.Remove(demoPath)
+			log.Printf("Error downloading demo %s: %v", job.MatchID, err)
+			err = withCode(ErrCodeDownload, err)
+			metadata := markDemoFailed(job.DemoID, err)
+			if job.Callback != nil {
+				notifyWebhook(job.Callback, job.DemoID, metadata, err)
+			}
 			return
 		}
 
-		// Save demo metadata
-		metadata, err := metadataStore.SaveMetadata(demoID, demoFilename)
-		if err != nil {
-			log.Printf("Warning: Failed to save metadata: %v", err)
-		} else {
-			// Restore MatchID if missing (though Filename should have it)
-			if metadata.MatchID == "" {
-				metadata.MatchID = matchID
-				metadataStore.UpdateMetadata(metadata)
-			}
-
-			// Save team information now that metadata exists
-			saveTeamMetadata(demoID, playerTeams)
+		log.Printf("Demo downloaded successfully to: %s", job.DemoPath)
 
-			// Enrich player data with Faceit information (nickname, ELO, level)
-			// Use existing matchData if available
-			if matchData != nil {
-				metadata.Players = faceitClient.EnrichPlayersFromMatch(metadata.Players, matchData)
-			}
-
-			for i := range metadata.Players {
-				if metadata.Players[i].Nickname == "" {
-					if err := faceitClient.EnrichPlayerInfo(&metadata.Players[i]); err != nil {
-						log.Printf("Warning: Failed to enrich player %s: %v", metadata.Players[i].SteamID, err)
-					}
-				}
-			}
-
-			// Save enriched metadata
-			metadataStore.UpdateMetadata(metadata)
-
-			// Register all generated audio files as temporary
-			for _, player := range metadata.Players {
-				registerTempFile(player.AudioFile)
+		// Queue for processing
+		if _, err := enqueueJob(initialMetadata, job); err != nil {
+			log.Printf("Error queueing demo %s: %v", job.DemoID, err)
+			if job.Callback != nil {
+				notifyWebhook(job.Callback, job.DemoID, initialMetadata, err)
 			}
 		}
-
-		log.Printf("Demo processing complete for match: %s", matchID)
 	}()
 
-	// Redirect back to home page immediately
-	http.Redirect(w, r, "/", http.StatusSeeOther)
+	return initialMetadata
 }
 
 // extractMatchIDFromURL extracts the match ID from a Faceit matchroom URL
@@ -861,7 +1094,7 @@ func cleanupExpiredFiles() {
 			}
 
 			// Delete associated metadata file if it exists
-			if strings.HasSuffix(filename, ".wav") {
+			if storage.IsAudioFile(filename) {
 				demoID := extractDemoIDFromFilename(filename)
 				if demoID != "" {
 					metadataPath := filepath.Join(outputDir, demoID+".json")
@@ -897,6 +1130,14 @@ func registerTempFile(filename string) {
 	log.Printf("Registered temporary file: %s (will be deleted in %v)", filename, tempFileLifetime)
 }
 
+// registerDemoOutputs registers every file generated for a demo as temporary
+func registerDemoOutputs(metadata *storage.DemoMetadata) {
+	registerTempFile(metadata.DemoID + ".json")
+	for _, filename := range metadata.OutputFiles() {
+		registerTempFile(filename)
+	}
+}
+
 // cleanExistingFiles removes all existing files in the output directory on startup
 func cleanExistingFiles() {
 	files, err := os.ReadDir(outputDir)
@@ -939,6 +1180,8 @@ func startUploadedDemoCleanup() {
 		select {
 		case <-ticker.C:
 			cleanupExpiredDemos()
+			cleanupExpiredSources()
+			cleanupExpiredUploads()
 		}
 	}
 }
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"time"
+
+	"github.com/markus-wa/demoinfocs-golang/v5/pkg/demoinfocs/common"
+)
+
+// mixdownSampleRate is the output rate of the mixed track; Steam voice at
+// lower rates is upsampled to it
+const mixdownSampleRate = 48000
+
+// Stereo positions of each side in the mixdown (-1 = left, 1 = right)
+const (
+	terroristPan        = -0.6
+	counterTerroristPan = 0.6
+)
+
+// mixdownWriter mixes every player's decoded voice into a single stereo track
+// aligned to demo time. Voice packets arrive in demo order, so everything
+// before the current packet's demo time is final and is flushed to disk,
+// keeping only a short window of audio in memory.
+type mixdownWriter struct {
+	outputPath string
+	format     OutputFormat
+	origin     time.Duration // Demo time of the first frame
+	sink       audioSink
+	pending    []float32      // Interleaved stereo frames starting at frame `flushed`
+	flushed    int            // Number of frames already written to the file
+	cursors    map[string]int // Next free frame for each player
+	resampled  []float32
+}
+
+func newMixdownWriter(outputPath string, format OutputFormat) *mixdownWriter {
+	return &mixdownWriter{
+		outputPath: outputPath,
+		format:     format,
+		cursors:    make(map[string]int, 10),
+	}
+}
+
+// Add mixes a player's decoded PCM into the track at the packet's demo time.
+// Audio that overlaps the player's previous transmission is appended after it.
+func (m *mixdownWriter) Add(steamID string, at demoPosition, sampleRate int, pcm []float32, team common.Team) error {
+	if len(pcm) == 0 {
+		return nil
+	}
+
+	if m.sink == nil {
+		sink, err := newAudioSink(m.outputPath, m.format, mixdownSampleRate, 2)
+		if err != nil {
+			return fmt.Errorf("failed to create mixdown file: %w", err)
+		}
+		m.sink = sink
+	}
+
+	frame := int((at.Time - m.origin).Seconds() * mixdownSampleRate)
+	if err := m.flushTo(frame); err != nil {
+		return err
+	}
+
+	if sampleRate != mixdownSampleRate {
+		m.resampled = resampleLinear(pcm, sampleRate, mixdownSampleRate, m.resampled[:0])
+		pcm = m.resampled
+	}
+
+	start := max(frame, m.cursors[steamID], m.flushed)
+	end := start + len(pcm)
+	if needed := (end - m.flushed) * 2; len(m.pending) < needed {
+		m.pending = append(m.pending, make([]float32, needed-len(m.pending))...)
+	}
+
+	left, right := panGains(team)
+	offset := (start - m.flushed) * 2
+	for i, sample := range pcm {
+		m.pending[offset+i*2] += sample * left
+		m.pending[offset+i*2+1] += sample * right
+	}
+
+	m.cursors[steamID] = end
+	return nil
+}
+
+// flushTo writes all frames before the given frame to disk, padding with
+// silence when no player was talking
+func (m *mixdownWriter) flushTo(frame int) error {
+	for m.flushed < frame {
+		count := min(frame-m.flushed, silenceChunkSamples)
+		if needed := count * 2; len(m.pending) < needed {
+			m.pending = append(m.pending, make([]float32, needed-len(m.pending))...)
+		}
+
+		if err := m.writeFrames(m.pending[:count*2]); err != nil {
+			return err
+		}
+
+		m.pending = m.pending[:copy(m.pending, m.pending[count*2:])]
+		m.flushed += count
+	}
+
+	return nil
+}
+
+func (m *mixdownWriter) writeFrames(samples []float32) error {
+	if err := m.sink.Write(samples); err != nil {
+		return fmt.Errorf("failed to write mixdown data: %w", err)
+	}
+	return nil
+}
+
+// Close flushes the remaining audio and finalizes the output file
+func (m *mixdownWriter) Close() error {
+	if m.sink == nil {
+		return nil
+	}
+
+	closeErr := m.flushTo(m.flushed + len(m.pending)/2)
+	if err := m.sink.Close(); closeErr == nil && err != nil {
+		closeErr = err
+	}
+
+	log.Printf("Mixed %d frames (%.1fs) to %s", m.flushed, float64(m.flushed)/mixdownSampleRate, m.outputPath)
+	return closeErr
+}
+
+// panGains returns equal-power left/right gains for a player's side
+func panGains(team common.Team) (left, right float32) {
+	pan := 0.0
+	switch team {
+	case common.TeamTerrorists:
+		pan = terroristPan
+	case common.TeamCounterTerrorists:
+		pan = counterTerroristPan
+	}
+
+	angle := (pan + 1) * math.Pi / 4
+	return float32(math.Cos(angle)), float32(math.Sin(angle))
+}
+
+// resampleLinear converts mono PCM between sample rates using linear
+// interpolation, appending the result to dst. Good enough for voice.
+func resampleLinear(pcm []float32, fromRate, toRate int, dst []float32) []float32 {
+	if fromRate == toRate || len(pcm) == 0 {
+		return append(dst, pcm...)
+	}
+
+	outLen := len(pcm) * toRate / fromRate
+	step := float64(fromRate) / float64(toRate)
+	for i := 0; i < outLen; i++ {
+		pos := float64(i) * step
+		index := int(pos)
+		if index >= len(pcm)-1 {
+			dst = append(dst, pcm[len(pcm)-1])
+			continue
+		}
+
+		frac := float32(pos - float64(index))
+		dst = append(dst, pcm[index]+(pcm[index+1]-pcm[index])*frac)
+	}
+
+	return dst
+}
@@ -0,0 +1,513 @@
+package main
+
+import (
+	"demovoice/api"
+	"demovoice/storage"
+	"encoding/json"
+	"net/http"
+	"path"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// openAPIVersion is the version of the API described by /api/openapi.json
+const openAPIVersion = "1.0.0"
+
+// apiParam is a query, path or header parameter of an operation
+type apiParam struct {
+	Name        string
+	In          string // "query", "path" or "header"
+	Type        string // JSON schema type
+	Enum        []string
+	Required    bool // Path parameters are always required
+	Description string
+}
+
+// apiOperation describes one endpoint for the OpenAPI document. Request and
+// response bodies are given as zero values of the Go types that are actually
+// encoded, so the document follows the structs.
+type apiOperation struct {
+	Method      string
+	Path        string
+	Tag         string
+	Summary     string
+	Auth        bool     // Requires an API key once any are configured
+	DemoAuth    []string // Demo access schemes accepted instead of a key
+	Params      []apiParam
+	Body        any    // JSON request body
+	Upload      bool   // multipart/form-data request with a "demo" file
+	RawBody     string // Content type of a binary request body
+	ContentType string // Response content type, application/json by default
+	Responses   map[int]any
+}
+
+var (
+	optionParams = []apiParam{
+		{Name: "chat_only", In: "query", Type: "boolean", Description: "Extract the chat log only"},
+		{Name: "tick_aligned", In: "query", Type: "boolean", Description: "Pad tracks with silence so they line up with demo time"},
+		{Name: "mixdown", In: "query", Type: "boolean", Description: "Also write a stereo mix of all players"},
+		{Name: "split_rounds", In: "query", Type: "boolean", Description: "Also write one clip per player per round"},
+		{Name: "format", In: "query", Type: "string", Enum: []string{string(FormatWAV32), string(FormatWAV16), string(FormatOggOpus)}, Description: "Audio output format"},
+		{Name: "callback_url", In: "query", Type: "string", Description: "URL notified when processing finishes"},
+		{Name: "callback_secret", In: "query", Type: "string", Description: "HMAC key used to sign the callback"},
+	}
+	demoIDPath = apiParam{Name: "id", In: "path", Type: "string", Description: "Demo ID"}
+	uploadPath = []apiParam{
+		{Name: "id", In: "path", Type: "string", Description: "Upload ID"},
+		{Name: "Tus-Resumable", In: "header", Type: "string", Description: "tus protocol version, 1.0.0"},
+	}
+
+	// errorBody is the {"error": "..."} body of the older JSON endpoints
+	errorBody = map[string]string{}
+
+	// demoTokenAuth accepts a demo's access token in the query or, for the
+	// session's current demo, in its cookie
+	demoTokenAuth = []string{"demoToken", "demoSession"}
+	// sessionAuth accepts a browser session with access to its current demo
+	sessionAuth = []string{"demoSession"}
+)
+
+// apiOperations lists every JSON endpoint of the server
+var apiOperations = []apiOperation{
+	{
+		Method: "POST", Path: "/api/upload", Tag: "uploads", Auth: true, Upload: true,
+		Summary: "Upload a demo for processing",
+		Params:  optionParams,
+		Responses: map[int]any{
+			200: APIUploadResponse{}, 400: APIUploadResponse{}, 401: APIUploadResponse{},
+			500: APIUploadResponse{}, 503: APIUploadResponse{},
+		},
+	},
+	{
+		Method: "GET", Path: "/status", Tag: "demos", Auth: true, DemoAuth: demoTokenAuth,
+		Summary:   "Get the processing status and results of a demo",
+		Params:    []apiParam{{Name: "demo_id", In: "query", Type: "string", Description: "Demo ID"}},
+		Responses: map[int]any{200: StatusResponse{}, 400: errorBody, 401: APIUploadResponse{}},
+	},
+	{
+		Method: "GET", Path: "/segments", Tag: "demos", Auth: true, DemoAuth: demoTokenAuth,
+		Summary: "Get the voice segment index of a demo",
+		Params: []apiParam{
+			{Name: "demo_id", In: "query", Type: "string", Description: "Demo ID"},
+			{Name: "steamid", In: "query", Type: "string", Description: "Only this player's segments"},
+			{Name: "round", In: "query", Type: "integer", Description: "Only segments of this round"},
+		},
+		Responses: map[int]any{200: storage.VoiceIndex{}, 400: errorBody, 401: APIUploadResponse{}, 404: errorBody},
+	},
+	{
+		Method: "GET", Path: "/events", Tag: "demos", Auth: true, DemoAuth: demoTokenAuth, ContentType: "text/event-stream",
+		Summary:   "Stream processing progress of a demo as Server-Sent Events",
+		Params:    []apiParam{{Name: "demo_id", In: "query", Type: "string", Description: "Demo ID"}},
+		Responses: map[int]any{200: ProgressEvent{}, 401: APIUploadResponse{}},
+	},
+	{
+		Method: "POST", Path: "/api/demos/{id}/reprocess", Tag: "demos", Auth: true,
+		Summary: "Process a demo again with other options from its retained source",
+		Params:  append([]apiParam{demoIDPath}, optionParams...),
+		Responses: map[int]any{
+			202: APIUploadResponse{}, 400: APIUploadResponse{}, 401: APIUploadResponse{}, 404: APIUploadResponse{},
+			409: APIUploadResponse{}, 410: APIUploadResponse{}, 503: APIUploadResponse{},
+		},
+	},
+	{
+		Method: "GET", Path: "/faceit/player", Tag: "faceit", Auth: true, DemoAuth: sessionAuth,
+		Summary:   "Look up a Faceit player by SteamID64",
+		Params:    []apiParam{{Name: "steamid", In: "query", Type: "string", Description: "SteamID64"}},
+		Responses: map[int]any{200: api.FaceitResponse{}, 401: APIUploadResponse{}},
+	},
+	{
+		Method: "GET", Path: "/faceit/match", Tag: "faceit", Auth: true, DemoAuth: sessionAuth,
+		Summary:   "Get Faceit match data",
+		Params:    []apiParam{{Name: "matchid", In: "query", Type: "string", Description: "Faceit match ID"}},
+		Responses: map[int]any{200: api.MatchResponse{}, 401: APIUploadResponse{}},
+	},
+	{
+		Method: "GET", Path: "/api/webhooks", Tag: "webhooks", Auth: true,
+		Summary: "List webhook deliveries",
+		Params: []apiParam{
+			{Name: "demo_id", In: "query", Type: "string", Description: "Only deliveries for this demo"},
+			{Name: "status", In: "query", Type: "string", Enum: []string{"pending", "delivered", "failed"}},
+		},
+		Responses: map[int]any{200: WebhookList{}, 401: APIUploadResponse{}},
+	},
+	{
+		Method: "GET", Path: "/api/webhooks/{id}", Tag: "webhooks", Auth: true,
+		Summary:   "Get a webhook delivery with its attempts",
+		Params:    []apiParam{{Name: "id", In: "path", Type: "string", Description: "Delivery ID"}},
+		Responses: map[int]any{200: storage.WebhookDelivery{}, 401: APIUploadResponse{}, 404: APIUploadResponse{}},
+	},
+	{
+		Method: "POST", Path: "/api/webhooks/{id}/replay", Tag: "webhooks", Auth: true,
+		Summary:   "Send a webhook delivery again",
+		Params:    []apiParam{{Name: "id", In: "path", Type: "string", Description: "Delivery ID"}},
+		Responses: map[int]any{202: storage.WebhookDelivery{}, 401: APIUploadResponse{}, 404: APIUploadResponse{}, 409: APIUploadResponse{}},
+	},
+	{
+		Method: "GET", Path: "/api/v1/demos", Tag: "v1", Auth: true,
+		Summary: "List demos, newest first",
+		Params: []apiParam{
+			{Name: "page", In: "query", Type: "integer"},
+			{Name: "per_page", In: "query", Type: "integer", Description: "At most " + strconv.Itoa(maxPageSize)},
+			{Name: "status", In: "query", Type: "string"},
+		},
+		Responses: map[int]any{200: DemoList{}, 400: APIError{}, 401: APIError{}},
+	},
+	{
+		Method: "POST", Path: "/api/v1/demos", Tag: "v1", Auth: true, Upload: true, Body: createDemoRequest{},
+		Summary: "Create a demo from an upload or a Faceit matchroom URL",
+		Params:  optionParams,
+		Responses: map[int]any{
+			200: DemoResource{}, 202: DemoResource{}, 400: APIError{}, 401: APIError{}, 500: APIError{}, 503: APIError{},
+		},
+	},
+	{
+		Method: "GET", Path: "/api/v1/demos/{id}", Tag: "v1", Auth: true,
+		Summary:   "Get a demo",
+		Params:    []apiParam{demoIDPath},
+		Responses: map[int]any{200: DemoResource{}, 401: APIError{}, 404: APIError{}},
+	},
+	{
+		Method: "DELETE", Path: "/api/v1/demos/{id}", Tag: "v1", Auth: true,
+		Summary:   "Delete a demo and its outputs",
+		Params:    []apiParam{demoIDPath},
+		Responses: map[int]any{204: nil, 401: APIError{}, 404: APIError{}, 409: APIError{}},
+	},
+	{
+		Method: "GET", Path: "/api/v1/demos/{id}/players", Tag: "v1", Auth: true,
+		Summary:   "Get the players of a demo",
+		Params:    []apiParam{demoIDPath},
+		Responses: map[int]any{200: PlayerList{}, 401: APIError{}, 404: APIError{}},
+	},
+	{
+		Method: "GET", Path: "/api/v1/demos/{id}/chat", Tag: "v1", Auth: true,
+		Summary:   "Get the structured chat log of a demo",
+		Params:    []apiParam{demoIDPath},
+		Responses: map[int]any{200: ChatLog{}, 401: APIError{}, 404: APIError{}},
+	},
+	{
+		Method: "POST", Path: "/api/v1/uploads", Tag: "uploads", Auth: true,
+		Summary: "Start a resumable (tus) upload",
+		Params: append([]apiParam{
+			{Name: "Upload-Length", In: "header", Type: "integer", Required: true, Description: "Size of the demo in bytes"},
+			{Name: "Upload-Metadata", In: "header", Type: "string", Required: true, Description: "tus metadata with a base64 filename and optionally checksum (sha256:<hex>)"},
+			{Name: "Tus-Resumable", In: "header", Type: "string", Description: "tus protocol version, 1.0.0"},
+		}, optionParams...),
+		Responses: map[int]any{201: UploadResource{}, 400: APIError{}, 401: APIError{}, 412: APIError{}, 500: APIError{}},
+	},
+	{
+		Method: "HEAD", Path: "/api/v1/uploads/{id}", Tag: "uploads", Auth: true,
+		Summary:   "Get the offset of an upload in Upload-Offset",
+		Params:    uploadPath,
+		Responses: map[int]any{200: nil, 401: nil, 404: nil},
+	},
+	{
+		Method: "GET", Path: "/api/v1/uploads/{id}", Tag: "uploads", Auth: true,
+		Summary:   "Get an upload, including its demo ID once complete",
+		Params:    uploadPath,
+		Responses: map[int]any{200: UploadResource{}, 401: APIError{}, 404: APIError{}},
+	},
+	{
+		Method: "PATCH", Path: "/api/v1/uploads/{id}", Tag: "uploads", Auth: true, RawBody: "application/offset+octet-stream",
+		Summary: "Append a chunk; after the last chunk the upload is verified and queued in the background. Chunks of an upload the key started don't count against its rate limit",
+		Params: append([]apiParam{
+			{Name: "Upload-Offset", In: "header", Type: "integer", Required: true, Description: "Offset the chunk starts at"},
+		}, uploadPath...),
+		Responses: map[int]any{
+			204: nil, 400: APIError{}, 401: APIError{}, 404: APIError{}, 409: APIError{}, 410: APIError{},
+			413: APIError{}, 415: APIError{}, 423: APIError{},
+		},
+	},
+	{
+		Method: "DELETE", Path: "/api/v1/uploads/{id}", Tag: "uploads", Auth: true,
+		Summary:   "Cancel an upload",
+		Params:    uploadPath,
+		Responses: map[int]any{204: nil, 401: APIError{}, 404: APIError{}},
+	},
+	{
+		Method: "GET", Path: "/api/v1/keys", Tag: "keys", Auth: true,
+		Summary:   "List API keys with their usage",
+		Responses: map[int]any{200: APIKeyList{}, 401: APIError{}},
+	},
+	{
+		Method: "POST", Path: "/api/v1/keys", Tag: "keys", Auth: true, Body: createAPIKeyRequest{},
+		Summary:   "Create an API key; the secret is only returned here",
+		Responses: map[int]any{201: APIKeyResource{}, 400: APIError{}, 401: APIError{}},
+	},
+	{
+		Method: "GET", Path: "/api/v1/keys/me", Tag: "keys", Auth: true,
+		Summary:   "Get the API key of the request with its limits and usage",
+		Responses: map[int]any{200: APIKeyResource{}, 401: APIError{}},
+	},
+	{
+		Method: "GET", Path: "/api/v1/keys/{id}", Tag: "keys", Auth: true,
+		Summary:   "Get an API key with its usage",
+		Params:    []apiParam{{Name: "id", In: "path", Type: "string", Description: "Key ID"}},
+		Responses: map[int]any{200: APIKeyResource{}, 401: APIError{}, 404: APIError{}},
+	},
+	{
+		Method: "DELETE", Path: "/api/v1/keys/{id}", Tag: "keys", Auth: true,
+		Summary:   "Revoke an API key",
+		Params:    []apiParam{{Name: "id", In: "path", Type: "string", Description: "Key ID"}},
+		Responses: map[int]any{200: APIKeyResource{}, 401: APIError{}, 404: APIError{}},
+	},
+}
+
+// openAPISpec is built once from apiOperations; only the server URL changes per request
+var openAPISpec = sync.OnceValue(func() map[string]any {
+	return buildOpenAPISpec(apiOperations)
+})
+
+// handleOpenAPI serves the OpenAPI 3.1 document of the JSON API
+func handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w)
+
+	spec := make(map[string]any, len(openAPISpec())+1)
+	for k, v := range openAPISpec() {
+		spec[k] = v
+	}
+	spec["servers"] = []map[string]string{{"url": publicBaseURL(r)}}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(spec)
+}
+
+// buildOpenAPISpec generates the OpenAPI document for a list of operations
+func buildOpenAPISpec(operations []apiOperation) map[string]any {
+	schemas := newSchemaRegistry()
+	paths := map[string]map[string]any{}
+
+	for _, op := range operations {
+		operation := map[string]any{
+			"summary":     op.Summary,
+			"tags":        []string{op.Tag},
+			"operationId": operationID(op),
+		}
+		if op.Auth {
+			security := []map[string][]string{{"apiKey": {}}}
+			for _, scheme := range op.DemoAuth {
+				security = append(security, map[string][]string{scheme: {}})
+			}
+			operation["security"] = security
+		}
+
+		if len(op.Params) > 0 {
+			var params []map[string]any
+			for _, p := range op.Params {
+				schema := map[string]any{"type": p.Type}
+				if len(p.Enum) > 0 {
+					schema["enum"] = p.Enum
+				}
+				param := map[string]any{"name": p.Name, "in": p.In, "schema": schema, "required": p.In == "path" || p.Required}
+				if p.Description != "" {
+					param["description"] = p.Description
+				}
+				params = append(params, param)
+			}
+			operation["parameters"] = params
+		}
+
+		content := map[string]any{}
+		if op.Upload {
+			content["multipart/form-data"] = map[string]any{"schema": map[string]any{
+				"type":       "object",
+				"properties": map[string]any{"demo": map[string]any{"type": "string", "format": "binary"}},
+			}}
+		}
+		if op.RawBody != "" {
+			content[op.RawBody] = map[string]any{"schema": map[string]any{"type": "string", "format": "binary"}}
+		}
+		if op.Body != nil {
+			content["application/json"] = map[string]any{"schema": schemas.schemaFor(reflect.TypeOf(op.Body))}
+		}
+		if len(content) > 0 {
+			operation["requestBody"] = map[string]any{"required": true, "content": content}
+		}
+
+		contentType := op.ContentType
+		if contentType == "" {
+			contentType = "application/json"
+		}
+		// Every authenticated endpoint can also reject the key's scope or rate
+		// limit, in the same shape as its 401
+		opResponses := op.Responses
+		if op.Auth {
+			opResponses = make(map[int]any, len(op.Responses)+2)
+			for status, body := range op.Responses {
+				opResponses[status] = body
+			}
+			opResponses[http.StatusForbidden] = op.Responses[http.StatusUnauthorized]
+			opResponses[http.StatusTooManyRequests] = op.Responses[http.StatusUnauthorized]
+		}
+
+		responses := map[string]any{}
+		for status, body := range opResponses {
+			description := http.StatusText(status)
+			if status == statusChecksumMismatch {
+				description = "Checksum Mismatch"
+			}
+			response := map[string]any{"description": description}
+			if body != nil {
+				// Errors are JSON even on streaming endpoints
+				bodyType := contentType
+				if status >= http.StatusBadRequest {
+					bodyType = "application/json"
+				}
+				response["content"] = map[string]any{
+					bodyType: map[string]any{"schema": schemas.schemaFor(reflect.TypeOf(body))},
+				}
+			}
+			responses[strconv.Itoa(status)] = response
+		}
+		operation["responses"] = responses
+
+		if paths[op.Path] == nil {
+			paths[op.Path] = map[string]any{}
+		}
+		paths[op.Path][strings.ToLower(op.Method)] = operation
+	}
+
+	return map[string]any{
+		"openapi": "3.1.0",
+		"info": map[string]any{
+			"title":   "CS Demo Voice Extractor API",
+			"version": openAPIVersion,
+		},
+		"paths": paths,
+		"components": map[string]any{
+			"schemas": schemas.schemas,
+			"securitySchemes": map[string]any{
+				"apiKey": map[string]string{"type": "apiKey", "in": "header", "name": "X-API-Key"},
+				"demoToken": map[string]string{
+					"type": "apiKey", "in": "query", "name": "access",
+					"description": "Access token of the requested demo, as returned in access_token on upload",
+				},
+				"demoSession": map[string]string{
+					"type": "apiKey", "in": "cookie", "name": demoAccessCookie,
+					"description": "Access token of the session's current demo, set by the web upload forms together with current_demo_id",
+				},
+			},
+		},
+	}
+}
+
+// operationID derives a stable operation name like "getApiV1DemosId"
+func operationID(op apiOperation) string {
+	id := strings.ToLower(op.Method)
+	for _, part := range strings.FieldsFunc(op.Path, func(r rune) bool {
+		return r == '/' || r == '{' || r == '}' || r == '_' || r == '.'
+	}) {
+		id += strings.ToUpper(part[:1]) + part[1:]
+	}
+	return id
+}
+
+// schemaRegistry turns Go types into JSON schemas, collecting named structs
+// as reusable components
+type schemaRegistry struct {
+	schemas map[string]any
+	names   map[reflect.Type]string
+}
+
+func newSchemaRegistry() *schemaRegistry {
+	return &schemaRegistry{schemas: map[string]any{}, names: map[reflect.Type]string{}}
+}
+
+var (
+	timeType = reflect.TypeOf(time.Time{})
+	rawType  = reflect.TypeOf(json.RawMessage{})
+)
+
+// schemaFor returns the schema of a type, following the encoding/json rules
+func (s *schemaRegistry) schemaFor(t reflect.Type) map[string]any {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	switch t {
+	case timeType:
+		return map[string]any{"type": "string", "format": "date-time"}
+	case rawType:
+		return map[string]any{}
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]any{"type": "string", "format": "byte"}
+		}
+		return map[string]any{"type": "array", "items": s.schemaFor(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": s.schemaFor(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return s.structSchema(t)
+		}
+		return map[string]any{"$ref": "#/components/schemas/" + s.register(t)}
+	}
+	return map[string]any{}
+}
+
+// register adds a named struct to the components and returns its name
+func (s *schemaRegistry) register(t reflect.Type) string {
+	if name, ok := s.names[t]; ok {
+		return name
+	}
+
+	// Qualify the name with its package when another package uses it too
+	name := t.Name()
+	if _, taken := s.schemas[name]; taken {
+		name = path.Base(t.PkgPath()) + "." + name
+	}
+
+	// Reserve the name before building the schema so recursive types resolve
+	s.names[t] = name
+	s.schemas[name] = nil
+	s.schemas[name] = s.structSchema(t)
+	return name
+}
+
+// structSchema describes the JSON object encoded for a struct
+func (s *schemaRegistry) structSchema(t reflect.Type) map[string]any {
+	properties := map[string]any{}
+	var required []string
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+
+		name, options, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" && options == "" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+
+		properties[name] = s.schemaFor(field.Type)
+		if !strings.Contains(options, "omitempty") && !strings.Contains(options, "omitzero") && field.Type.Kind() != reflect.Pointer {
+			required = append(required, name)
+		}
+	}
+
+	schema := map[string]any{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		sort.Strings(required)
+		schema["required"] = required
+	}
+	return schema
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"demovoice/storage"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	outputURLKey []byte          // HMAC key of signed output URLs
+	outputURLTTL = 1 * time.Hour // How long a signed output URL stays valid
+)
+
+// loadOutputURLKey reads the URL signing key from OUTPUT_URL_SECRET, or from
+// a file that is created with a random key on first start so that handed out
+// URLs survive restarts
+func loadOutputURLKey(path string) error {
+	if secret := os.Getenv("OUTPUT_URL_SECRET"); secret != "" {
+		outputURLKey = []byte(secret)
+		return nil
+	}
+
+	if key, err := os.ReadFile(path); err == nil && len(key) > 0 {
+		outputURLKey = key
+		return nil
+	}
+
+	key := make([]byte, 32)
+	rand.Read(key)
+	if err := os.WriteFile(path, key, 0600); err != nil {
+		return err
+	}
+	outputURLKey = key
+	return nil
+}
+
+// outputSignature signs a filename together with its expiry time
+func outputSignature(filename, expires string) string {
+	mac := hmac.New(sha256.New, outputURLKey)
+	mac.Write([]byte(filename + "\n" + expires))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// signedOutputURL returns a download URL for a file in the output directory
+// that is valid for outputURLTTL
+func signedOutputURL(filename string) string {
+	if filename == "" {
+		return ""
+	}
+
+	expires := strconv.FormatInt(time.Now().Add(outputURLTTL).Unix(), 10)
+	return "/output/" + url.PathEscape(filename) + "?expires=" + expires + "&sig=" + outputSignature(filename, expires)
+}
+
+// outputURLs returns signed download URLs of the output files of every run
+// of a demo, by filename
+func outputURLs(metadata *storage.DemoMetadata) map[string]string {
+	files := metadata.AllOutputFiles()
+	if len(files) == 0 {
+		return nil
+	}
+
+	urls := make(map[string]string, len(files))
+	for _, filename := range files {
+		urls[filename] = signedOutputURL(filename)
+	}
+	return urls
+}
+
+// handleOutput serves a file from the output directory when the request
+// carries a valid, unexpired signature. Range requests are supported.
+func handleOutput(w http.ResponseWriter, r *http.Request) {
+	filename := strings.TrimPrefix(r.URL.Path, "/output/")
+	if filename == "" || filename != filepath.Base(filename) || strings.HasPrefix(filename, ".") {
+		http.NotFound(w, r)
+		return
+	}
+
+	query := r.URL.Query()
+	expires := query.Get("expires")
+	expiresAt, err := strconv.ParseInt(expires, 10, 64)
+	signature := outputSignature(filename, expires)
+	if err != nil || !hmac.Equal([]byte(signature), []byte(query.Get("sig"))) {
+		http.Error(w, "Invalid download link", http.StatusForbidden)
+		return
+	}
+	if time.Now().Unix() > expiresAt {
+		http.Error(w, "Download link has expired", http.StatusGone)
+		return
+	}
+
+	file, err := os.Open(filepath.Join(outputDir, filename))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil || info.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+
+	// The link is the credential, so only the client holding it may cache it
+	w.Header().Set("Cache-Control", "private, max-age="+strconv.FormatInt(max(expiresAt-time.Now().Unix(), 0), 10))
+	http.ServeContent(w, r, filename, info.ModTime(), file)
+}
+
+// setOutputURLTTL reads OUTPUT_URL_TTL
+func setOutputURLTTL() {
+	value := os.Getenv("OUTPUT_URL_TTL")
+	if value == "" {
+		return
+	}
+
+	ttl, err := time.ParseDuration(value)
+	if err != nil || ttl <= 0 {
+		log.Printf("Warning: Invalid OUTPUT_URL_TTL %q, links stay valid for %v", value, outputURLTTL)
+		return
+	}
+	outputURLTTL = ttl
+}
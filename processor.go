@@ -3,69 +3,152 @@ package main
 import (
 	"bufio"
 	"demovoice/decoder"
+	"demovoice/storage"
 	"fmt"
 	"io"
 	"log"
 	"os"
 	"path/filepath"
 	"runtime"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
-	"github.com/go-audio/audio"
-	"github.com/go-audio/wav"
 	"github.com/klauspost/compress/zstd"
 	dem "github.com/markus-wa/demoinfocs-golang/v5/pkg/demoinfocs"
+	"github.com/markus-wa/demoinfocs-golang/v5/pkg/demoinfocs/common"
 	"github.com/markus-wa/demoinfocs-golang/v5/pkg/demoinfocs/events"
 	msgs2 "github.com/markus-wa/demoinfocs-golang/v5/pkg/demoinfocs/msg"
 )
 
+// silenceChunkSamples bounds how many silent samples are buffered per write
+// when padding tick-aligned tracks.
+const silenceChunkSamples = 48000
+
+// segmentGap is the pause between voice packets after which a new speech
+// segment is started in the segment index.
+const segmentGap = 500 * time.Millisecond
+
+// wavHeaderSize is the size of the WAV header written by go-audio/wav, used
+// to compute byte offsets of segments.
+const wavHeaderSize = 44
+
+// ProcessOptions controls what ProcessDemo extracts and how it is written
+type ProcessOptions struct {
+	// ChatOnly extracts only chat logs (much faster, no voice processing)
+	ChatOnly bool
+	// TickAligned pads each player's track with silence so that every file
+	// starts at the beginning of the demo and each transmission is placed at
+	// the demo time it was received
+	TickAligned bool
+	// Mixdown additionally writes a single stereo track of all players,
+	// aligned to demo time with Terrorists panned left and CTs right
+	Mixdown bool
+	// SplitRounds additionally writes one clip per player per round (and a
+	// per-round mixdown when Mixdown is set)
+	SplitRounds bool
+	// Format selects the audio container and encoding (default FormatWAV32)
+	Format OutputFormat
+}
+
+// ProcessResult holds what ProcessDemo learned about the demo besides the
+// audio and chat files it wrote
+type ProcessResult struct {
+	PlayerTeams  map[string]int               // SteamID64 -> team number at the end of the demo
+	DecodeErrors map[string]int               // SteamID64 -> voice packets that failed to decode
+	FrameLoss    map[string]decoder.LossStats // SteamID64 -> lost Steam voice frames
+	Rounds       []storage.RoundInfo          // Only populated when splitting by round
+	Warnings     []string                     // Problems that were worked around, such as a player's voice format changing
+}
+
+// errorTrackingReader remembers the first read error other than io.EOF, so
+// decompression failures can be told apart from parse errors
+type errorTrackingReader struct {
+	r   io.Reader
+	err error
+}
+
+func (t *errorTrackingReader) Read(p []byte) (int, error) {
+	n, err := t.r.Read(p)
+	if err != nil && err != io.EOF && t.err == nil {
+		t.err = err
+	}
+	return n, err
+}
+
+// demoPosition is the point in the demo at which a voice packet was received
+type demoPosition struct {
+	Tick  int
+	Time  time.Duration
+	Round int
+}
 
 // ProcessDemo processes a demo file and extracts voice data with optimizations
-// The demoID parameter is used to associate voice files with a specific demo
-// If chatOnly is true, only chat logs are extracted (much faster, no voice processing)
-func ProcessDemo(demoPath string, demoID string, chatOnly bool) (playerTeams map[string]int, err error) {
+// The demoID parameter is used to associate voice files with a specific demo;
+// the files are named after outputID (see storage.RunOutputID)
+func ProcessDemo(demoPath string, demoID, outputID string, opts ProcessOptions) (result *ProcessResult, err error) {
 	// Recover from panics in the parser
 	defer func() {
 		if r := recover(); r != nil {
-			err = fmt.Errorf("panic during demo processing: %v", r)
+			err = withCode(ErrCodeParserPanic, fmt.Errorf("panic during demo processing: %v", r))
 			log.Printf("❌ Recovered from panic in ProcessDemo: %v", r)
 		}
 	}()
 
 	startTime := time.Now()
 
+	if opts.Format == "" {
+		opts.Format = FormatWAV32
+	}
+
 	voiceWriters := make(map[string]*voiceStreamWriter, 10)
-	playerTeams = make(map[string]int, 10)
+	result = &ProcessResult{
+		PlayerTeams:  make(map[string]int, 10),
+		DecodeErrors: make(map[string]int, 10),
+		FrameLoss:    make(map[string]decoder.LossStats, 10),
+	}
 	var chatLogs []string
+	var chatMessages []storage.ChatMessage
 	var voiceProcessingErr error
 
 	// Track voice packets for progress
 	var voicePacketCount int64
 
+	var mix *mixdownWriter
+	if opts.Mixdown && !opts.ChatOnly {
+		mix = newMixdownWriter(filepath.Join(outputDir, storage.MixdownFilename(outputID, opts.Format.Extension())), opts.Format)
+	}
+
+	var splitter *roundSplitter
+	if opts.SplitRounds && !opts.ChatOnly {
+		splitter = newRoundSplitter(outputID, opts)
+	}
+
 	// Open the demo file
 	file, err := os.Open(demoPath)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open demo file: %v", err)
+		return nil, withCode(ErrCodeFileUnreadable, fmt.Errorf("failed to open demo file: %v", err))
 	}
 	defer file.Close()
 
 	// Get file size for progress logging
 	fileInfo, err := file.Stat()
 	if err != nil {
-		return nil, fmt.Errorf("failed to stat demo file: %v", err)
+		return nil, withCode(ErrCodeFileUnreadable, fmt.Errorf("failed to stat demo file: %v", err))
 	}
 	fileSizeMB := float64(fileInfo.Size()) / (1024 * 1024)
 	log.Printf("Demo file size: %.2f MB", fileSizeMB)
 
 	if fileInfo.Size() < 100 {
-		return nil, fmt.Errorf("demo file too small or empty: %d bytes", fileInfo.Size())
+		return nil, withCode(ErrCodeFileTooSmall, fmt.Errorf("demo file too small or empty: %d bytes", fileInfo.Size()))
 	}
 
-	cleanupOldDemoFiles(demoID)
+	cleanupOldDemoFiles(outputID)
 
 	var demoReader io.Reader = bufio.NewReaderSize(file, 16*1024*1024)
+	var decompressed *errorTrackingReader
 
 	// Check if file is zstd compressed (.dem.zst) and decompress if needed
 	if strings.HasSuffix(strings.ToLower(demoPath), ".zst") {
@@ -76,11 +159,12 @@ func ProcessDemo(demoPath string, demoID string, chatOnly bool) (playerTeams map
 			zstd.WithDecoderLowmem(false),
 		)
 		if err != nil {
-			return nil, fmt.Errorf("failed to create zstd decoder: %v", err)
+			return nil, withCode(ErrCodeDecompression, fmt.Errorf("failed to create zstd decoder: %v", err))
 		}
 
 		defer zstdDecoder.Close()
-		demoReader = zstdDecoder
+		decompressed = &errorTrackingReader{r: zstdDecoder}
+		demoReader = decompressed
 	}
 
 	// Use optimized parser config for faster parsing
@@ -106,19 +190,72 @@ func ProcessDemo(demoPath string, demoID string, chatOnly bool) (playerTeams map
 		}
 	}()
 
+	// Publish progress for /events subscribers. This runs on the parser's
+	// goroutine so the voice writers can be read safely.
+	var lastProgress time.Time
+	parser.RegisterEventHandler(func(events.FrameDone) {
+		if time.Since(lastProgress) < progressInterval {
+			return
+		}
+		lastProgress = time.Now()
+
+		packets := make(map[string]int, len(voiceWriters))
+		for steamID, writer := range voiceWriters {
+			packets[steamID] = writer.packetCount
+		}
+		progress.Publish(ProgressEvent{
+			DemoID:  demoID,
+			Status:  "parsing",
+			Percent: float64(parser.Progress()) * 100,
+			Packets: packets,
+		})
+	})
+
 	// Register chat message handler
 	parser.RegisterEventHandler(func(e events.ChatMessage) {
-		senderName := "Console"
+		gameState := parser.GameState()
+		message := storage.ChatMessage{
+			Tick:    gameState.IngameTick(),
+			Time:    parser.CurrentTime().Seconds(),
+			Round:   gameState.TotalRoundsPlayed() + 1,
+			Name:    "Console",
+			AllChat: e.IsChatAll,
+			Text:    e.Text,
+		}
 		if e.Sender != nil {
-			senderName = e.Sender.Name
+			message.SteamID = strconv.FormatUint(e.Sender.SteamID64, 10)
+			message.Name = e.Sender.Name
+			message.Team = teamName(e.Sender.Team)
+			message.Alive = e.Sender.IsAlive()
 		}
+		chatMessages = append(chatMessages, message)
 
 		// Note: FACEIT demos only contain all chat, not team chat
-		chatLogs = append(chatLogs, fmt.Sprintf("[%s] %s: %s", parser.CurrentTime().String(), senderName, e.Text))
+		chatLogs = append(chatLogs, fmt.Sprintf("[%s] %s: %s", parser.CurrentTime().String(), message.Name, e.Text))
 	})
 
+	if splitter != nil {
+		parser.RegisterEventHandler(func(e events.RoundStart) {
+			gameState := parser.GameState()
+			if gameState.IsWarmupPeriod() {
+				return
+			}
+
+			at := demoPosition{Tick: gameState.IngameTick(), Time: parser.CurrentTime()}
+			number := gameState.TotalRoundsPlayed() + 1
+			if err := splitter.StartRound(number, at, gameState.TeamTerrorists(), gameState.TeamCounterTerrorists()); err != nil && voiceProcessingErr == nil {
+				voiceProcessingErr = withCode(ErrCodeOutputWrite, err)
+			}
+		})
+
+		parser.RegisterEventHandler(func(e events.RoundEnd) {
+			at := demoPosition{Tick: parser.GameState().IngameTick(), Time: parser.CurrentTime()}
+			splitter.EndRound(at, e.Winner)
+		})
+	}
+
 	// Only register voice handler if not chat-only mode
-	if !chatOnly {
+	if !opts.ChatOnly {
 		// Optimize parser - only register voice data handler
 		// Skip other events to reduce parsing overhead
 		parser.RegisterNetMessageHandler(func(m *msgs2.CSVCMsg_VoiceData) {
@@ -134,12 +271,28 @@ func ProcessDemo(demoPath string, demoID string, chatOnly bool) (playerTeams map
 			steamId := strconv.FormatUint(m.GetXuid(), 10)
 			writer, exists := voiceWriters[steamId]
 			if !exists {
-				writer = newVoiceStreamWriter(filepath.Join(outputDir, fmt.Sprintf("%s_%s.wav", steamId, demoID)))
+				path := filepath.Join(outputDir, fmt.Sprintf("%s_%s%s", steamId, outputID, opts.Format.Extension()))
+				writer = newVoiceStreamWriter(steamId, path, opts)
+				writer.mix = mix
 				voiceWriters[steamId] = writer
 			}
 
-			if err := writer.WritePacket(m.Audio.VoiceData, m.Audio.Format.String()); err != nil && voiceProcessingErr == nil {
-				voiceProcessingErr = fmt.Errorf("player %s: %w", steamId, err)
+			if splitter != nil {
+				writer.roundClip = splitter.ClipFor(steamId)
+			}
+
+			if mix != nil {
+				writer.team = playerTeam(parser, m.GetXuid())
+			}
+
+			at := demoPosition{
+				Tick:  parser.GameState().IngameTick(),
+				Time:  parser.CurrentTime(),
+				Round: parser.GameState().TotalRoundsPlayed() + 1,
+			}
+
+			if err := writer.WritePacket(m.Audio.VoiceData, m.Audio.Format.String(), at); err != nil && voiceProcessingErr == nil {
+				voiceProcessingErr = withCode(ErrCodeVoiceProcessing, fmt.Errorf("player %s: %w", steamId, err))
 			}
 		})
 	}
@@ -150,27 +303,59 @@ func ProcessDemo(demoPath string, demoID string, chatOnly bool) (playerTeams map
 	close(stopProgress) // Stop progress logging
 	parseTime := time.Since(startTime)
 	closeErr := closeVoiceWriters(voiceWriters)
+	if mix != nil {
+		if err := mix.Close(); err != nil && closeErr == nil {
+			closeErr = withCode(ErrCodeOutputWrite, fmt.Errorf("failed to close mixdown: %w", err))
+		}
+	}
+	if splitter != nil {
+		rounds, err := splitter.Close()
+		if err != nil && closeErr == nil {
+			closeErr = err
+		}
+		result.Rounds = rounds
+	}
+	if decompressed != nil && decompressed.err != nil {
+		return nil, withCode(ErrCodeDecompression, fmt.Errorf("failed to decompress demo: %w", decompressed.err))
+	}
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse demo: %v", err)
+		return nil, withCode(ErrCodeParse, fmt.Errorf("failed to parse demo: %v", err))
 	}
 	log.Printf("Demo parsing completed for %s in %.2fs (%.2f MB/s, %d voice packets)",
 		demoID, parseTime.Seconds(), fileSizeMB/parseTime.Seconds(), voicePacketCount)
 
+	for steamID, writer := range voiceWriters {
+		if writer.decodeErrors > 0 {
+			result.DecodeErrors[steamID] = writer.decodeErrors
+		}
+		if loss := writer.frameLoss(); loss != (decoder.LossStats{}) {
+			result.FrameLoss[steamID] = loss
+		}
+		for _, message := range writer.warnings {
+			result.Warnings = append(result.Warnings, fmt.Sprintf("player %s: %s", steamID, message))
+		}
+	}
+	sort.Strings(result.Warnings)
+
 	if voiceProcessingErr != nil {
 		return nil, voiceProcessingErr
 	}
 	if closeErr != nil {
-		return nil, closeErr
+		return nil, withCode(ErrCodeOutputWrite, closeErr)
 	}
 
 	// Capture team info from parser state after parsing
 	for _, player := range parser.GameState().Participants().All() {
-		playerTeams[strconv.FormatUint(player.SteamID64, 10)] = int(player.Team)
+		steamID := strconv.FormatUint(player.SteamID64, 10)
+		result.PlayerTeams[steamID] = int(player.Team)
+		if writer, exists := voiceWriters[steamID]; exists {
+			writer.playerName = player.Name
+		}
 	}
 
 	// Save chat logs
 	if len(chatLogs) > 0 {
-		chatLogPath := filepath.Join(outputDir, demoID+"_chat.txt")
+		chatLogPath := filepath.Join(outputDir, outputID+"_chat.txt")
 		f, err := os.Create(chatLogPath)
 		if err == nil {
 			defer f.Close()
@@ -181,57 +366,85 @@ func ProcessDemo(demoPath string, demoID string, chatOnly bool) (playerTeams map
 		} else {
 			log.Printf("Failed to save chat logs: %v", err)
 		}
+
+		if err := metadataStore.SaveChatMessages(outputID, chatMessages); err != nil {
+			log.Printf("Failed to save structured chat log: %v", err)
+		}
 	}
 
 	// If chat-only mode, skip voice processing entirely
-	if chatOnly {
+	if opts.ChatOnly {
 		log.Printf("Chat-only mode: Skipping voice processing for demo %s", demoID)
-		return playerTeams, nil
+		return result, nil
 	}
 
 	if countVoiceWritersWithAudio(voiceWriters) == 0 {
 		log.Printf("No voice data found in demo %s", demoID)
-		return playerTeams, nil
+		return result, nil
 	}
 
-	return playerTeams, nil
+	if err := saveVoiceIndex(demoID, outputID, voiceWriters); err != nil {
+		log.Printf("Failed to save voice segment index: %v", err)
+	}
+
+	return result, nil
 }
 
 type voiceStreamWriter struct {
+	steamID       string
 	outputPath    string
 	format        string
 	sampleRate    int
-	file          *os.File
-	encoder       *wav.Encoder
+	outputFormat  OutputFormat
+	sink          audioSink
 	steamDecoder  *decoder.OpusDecoder
+	steamRate     int               // Sample rate steamDecoder was created for
+	lostFrames    decoder.LossStats // Frame loss of Steam decoders replaced after a rate change
 	opusDecoder   *decoder.RawOpusDecoder
 	floatScratch  []float32
-	intScratch    []int
+	resampled     []float32
+	silence       []float32
+	tickAligned   bool
+	playerName    string
+	mix           *mixdownWriter
+	team          common.Team // Current side, used for mixdown panning
+	roundClip     *voiceStreamWriter
+	origin        time.Duration // Demo time tick-aligned output starts at
+	segments      []storage.VoiceSegment
+	inSegment     bool
 	packetCount   int
 	sampleCount   int
 	decodeErrors  int
 	unsupported   bool
+	warnings      []string
+	skipped       map[decoder.SectionType]int // Steam voice sections of unknown types or other codecs
 	closeComplete bool
 }
 
-func newVoiceStreamWriter(outputPath string) *voiceStreamWriter {
+func newVoiceStreamWriter(steamID, outputPath string, opts ProcessOptions) *voiceStreamWriter {
 	return &voiceStreamWriter{
+		steamID:      steamID,
 		outputPath:   outputPath,
+		outputFormat: opts.Format,
 		floatScratch: make([]float32, 0, decoder.FrameSize*2),
-		intScratch:   make([]int, 0, decoder.FrameSize*2),
+		tickAligned:  opts.TickAligned,
 	}
 }
 
-func (w *voiceStreamWriter) WritePacket(payload []byte, format string) error {
+// WritePacket decodes a voice packet and appends it to the output file.
+// at is the demo position the packet was received at; it is only used to
+// place the audio when the writer is tick-aligned.
+func (w *voiceStreamWriter) WritePacket(payload []byte, format string, at demoPosition) error {
 	if w.closeComplete {
 		return fmt.Errorf("cannot write packet after closing %s", w.outputPath)
 	}
 
-	if w.format == "" {
-		w.format = format
-	} else if w.format != format {
-		return fmt.Errorf("voice format changed from %s to %s", w.format, format)
+	// Each format has its own decoder, and writePCM resamples to the rate the
+	// track started with, so a player switching formats just keeps going
+	if w.format != "" && w.format != format {
+		w.warn("voice format changed from %s to %s", w.format, format)
 	}
+	w.format = format
 
 	w.packetCount++
 
@@ -253,7 +466,7 @@ func (w *voiceStreamWriter) WritePacket(payload []byte, format string) error {
 			return nil
 		}
 
-		return w.writePCM(48000, pcm)
+		return w.writePCM(48000, pcm, at)
 	case "VOICEDATA_FORMAT_STEAM":
 		chunk, err := decoder.DecodeChunk(payload)
 		if err != nil {
@@ -261,34 +474,33 @@ func (w *voiceStreamWriter) WritePacket(payload []byte, format string) error {
 			log.Printf("Error decoding Steam voice chunk for %s: %v", w.outputPath, err)
 			return nil
 		}
-		if chunk == nil || len(chunk.Data) == 0 {
-			return nil
-		}
-
-		sampleRate := int(chunk.SampleRate)
-		if sampleRate == 0 {
-			sampleRate = 24000
-		}
 
-		if w.steamDecoder == nil {
-			steamDecoder, err := decoder.NewOpusDecoder(sampleRate, 1)
-			if err != nil {
-				return fmt.Errorf("failed to create Steam voice decoder: %w", err)
+		// Sections apply in order; a sample rate section sets the rate of
+		// the sections after it
+		sampleRate := 24000
+		for _, section := range chunk.Sections {
+			switch section.Type {
+			case decoder.SectionSampleRate:
+				if section.Value != 0 {
+					sampleRate = int(section.Value)
+				}
+			case decoder.SectionSilence:
+				if err := w.writeSteamSilence(int(section.Value), sampleRate); err != nil {
+					return err
+				}
+			case decoder.SectionOpusPLC:
+				if err := w.writeSteamOpus(section.Data, sampleRate, at); err != nil {
+					return err
+				}
+			case decoder.SectionOpus:
+				// Its framing is undocumented, so decoding it would only produce noise
+				w.warn("Steam voice sections with plain Opus frames (type 0x05) are not supported, that audio is missing")
+				w.skipSection(section.Type)
+			default:
+				w.skipSection(section.Type)
 			}
-			w.steamDecoder = steamDecoder
-		} else if w.sampleRate != 0 && w.sampleRate != sampleRate {
-			return fmt.Errorf("Steam voice sample rate changed from %d to %d", w.sampleRate, sampleRate)
 		}
-
-		w.floatScratch = w.floatScratch[:0]
-		pcm, err := w.steamDecoder.DecodeInto(chunk.Data, w.floatScratch)
-		if err != nil {
-			w.decodeErrors++
-			log.Printf("Error decoding Steam voice PCM for %s: %v", w.outputPath, err)
-			return nil
-		}
-
-		return w.writePCM(sampleRate, pcm)
+		return nil
 	default:
 		if !w.unsupported {
 			w.unsupported = true
@@ -299,22 +511,21 @@ func (w *voiceStreamWriter) WritePacket(payload []byte, format string) error {
 }
 
 func (w *voiceStreamWriter) ensureOutput(sampleRate int) error {
-	if w.encoder != nil {
+	if w.sink != nil {
 		return nil
 	}
 
-	file, err := os.Create(w.outputPath)
+	sink, err := newAudioSink(w.outputPath, w.outputFormat, sampleRate, 1)
 	if err != nil {
-		return fmt.Errorf("failed to create WAV file: %w", err)
+		return err
 	}
 
-	w.file = file
+	w.sink = sink
 	w.sampleRate = sampleRate
-	w.encoder = wav.NewEncoder(file, sampleRate, 32, 1, 1)
 	return nil
 }
 
-func (w *voiceStreamWriter) writePCM(sampleRate int, pcm []float32) error {
+func (w *voiceStreamWriter) writePCM(sampleRate int, pcm []float32, at demoPosition) error {
 	if len(pcm) == 0 {
 		return nil
 	}
@@ -323,29 +534,194 @@ func (w *voiceStreamWriter) writePCM(sampleRate int, pcm []float32) error {
 		return err
 	}
 
-	if cap(w.intScratch) < len(pcm) {
-		w.intScratch = make([]int, len(pcm))
-	} else {
-		w.intScratch = w.intScratch[:len(pcm)]
+	if w.mix != nil {
+		if err := w.mix.Add(w.steamID, at, sampleRate, pcm, w.team); err != nil {
+			return err
+		}
+	}
+
+	if w.roundClip != nil {
+		w.roundClip.team = w.team
+		if err := w.roundClip.writePCM(sampleRate, pcm, at); err != nil {
+			return err
+		}
+	}
+
+	// The track keeps the rate it started with
+	if sampleRate != w.sampleRate {
+		if sampleRate > w.sampleRate {
+			w.warn("voice at %d Hz was downsampled to %d Hz without filtering, so it may contain aliasing", sampleRate, w.sampleRate)
+		}
+		w.resampled = resampleLinear(pcm, sampleRate, w.sampleRate, w.resampled[:0])
+		pcm = w.resampled
+	}
+
+	// Pad up to the packet's demo time. Audio that is still playing when the
+	// next packet arrives is appended as-is rather than cut off.
+	if w.tickAligned {
+		target := int((at.Time - w.origin).Seconds() * float64(w.sampleRate))
+		if err := w.writeSilence(target - w.sampleCount); err != nil {
+			return err
+		}
+	}
+
+	if !w.inSegment || at.Time.Seconds()-w.segments[len(w.segments)-1].EndTime > segmentGap.Seconds() {
+		w.beginSegment(at)
+	}
+
+	if err := w.writeSamples(pcm); err != nil {
+		return err
+	}
+
+	segment := &w.segments[len(w.segments)-1]
+	segment.EndTick = at.Tick
+	segment.EndTime = at.Time.Seconds() + float64(len(pcm))/float64(w.sampleRate)
+	segment.EndSample = w.sampleCount
+	segment.EndByte = w.byteOffset(w.sampleCount)
+	return nil
+}
+
+// skipSection counts a Steam voice section that was not decoded
+func (w *voiceStreamWriter) skipSection(sectionType decoder.SectionType) {
+	if w.skipped == nil {
+		w.skipped = make(map[decoder.SectionType]int)
 	}
+	w.skipped[sectionType]++
+}
 
-	for i, sample := range pcm {
-		w.intScratch[i] = int(sample * 2147483647)
+// warn records a problem that did not stop processing, once per message
+func (w *voiceStreamWriter) warn(format string, args ...any) {
+	message := fmt.Sprintf(format, args...)
+	if slices.Contains(w.warnings, message) {
+		return
 	}
 
-	buf := &audio.IntBuffer{
-		Data: w.intScratch,
-		Format: &audio.Format{
-			SampleRate:  sampleRate,
-			NumChannels: 1,
-		},
+	log.Printf("⚠️  %s: %s", w.outputPath, message)
+	w.warnings = append(w.warnings, message)
+}
+
+// frameLoss returns the lost frame counts of every Steam decoder used so far
+func (w *voiceStreamWriter) frameLoss() decoder.LossStats {
+	loss := w.lostFrames
+	if w.steamDecoder != nil {
+		stats := w.steamDecoder.Stats()
+		loss.Recovered += stats.Recovered
+		loss.Concealed += stats.Concealed
+		loss.Late += stats.Late
+	}
+	return loss
+}
+
+// writeSteamOpus decodes a Steam Opus PLC section and appends it
+func (w *voiceStreamWriter) writeSteamOpus(data []byte, sampleRate int, at demoPosition) error {
+	// An Opus decoder only works at one rate; start a new one after a change
+	if w.steamDecoder != nil && w.steamRate != sampleRate {
+		w.warn("Steam voice sample rate changed from %d to %d Hz", w.steamRate, sampleRate)
+		w.lostFrames = w.frameLoss()
+		w.steamDecoder = nil
 	}
 
-	if err := w.encoder.Write(buf); err != nil {
-		return fmt.Errorf("failed to write WAV data: %w", err)
+	if w.steamDecoder == nil {
+		steamDecoder, err := decoder.NewOpusDecoder(sampleRate, 1)
+		if err != nil {
+			return fmt.Errorf("failed to create Steam voice decoder: %w", err)
+		}
+		w.steamDecoder = steamDecoder
+		w.steamRate = sampleRate
 	}
 
-	w.sampleCount += len(pcm)
+	w.floatScratch = w.floatScratch[:0]
+	pcm, err := w.steamDecoder.DecodeInto(data, w.floatScratch)
+	if err != nil {
+		w.decodeErrors++
+		log.Printf("Error decoding Steam voice PCM for %s: %v", w.outputPath, err)
+		return nil
+	}
+
+	return w.writePCM(sampleRate, pcm, at)
+}
+
+// writeSteamSilence turns a run of Steam silence frames into zero samples so
+// pauses within a transmission are kept. A run of at least segmentGap ends
+// the current utterance, like a gap between packets would; shorter pauses
+// belong to it. Silence before any audio is skipped, and runs are capped at
+// segmentGap since longer pauses start a new utterance anyway. Tick-aligned
+// tracks write no zeros, since the next packet is padded to its demo time
+// and zeros written here would push it later.
+func (w *voiceStreamWriter) writeSteamSilence(frames, sampleRate int) error {
+	if w.roundClip != nil {
+		if err := w.roundClip.writeSteamSilence(frames, sampleRate); err != nil {
+			return err
+		}
+	}
+
+	if w.sink == nil || !w.inSegment {
+		return nil
+	}
+
+	// Frames are counted at the packet's rate; the track may use another
+	seconds := float64(frames*decoder.FrameSize) / float64(sampleRate)
+	if seconds >= segmentGap.Seconds() {
+		w.endSegment()
+	}
+	if w.tickAligned {
+		return nil
+	}
+
+	seconds = min(seconds, segmentGap.Seconds())
+	return w.writeSilence(int(seconds * float64(w.sampleRate)))
+}
+
+// beginSegment starts a new utterance at the current end of the track
+func (w *voiceStreamWriter) beginSegment(at demoPosition) {
+	w.segments = append(w.segments, storage.VoiceSegment{
+		StartTick:   at.Tick,
+		StartTime:   at.Time.Seconds(),
+		Round:       at.Round,
+		StartSample: w.sampleCount,
+		StartByte:   w.byteOffset(w.sampleCount),
+	})
+	w.inSegment = true
+}
+
+// endSegment closes the current utterance; the next packet starts a new one
+func (w *voiceStreamWriter) endSegment() {
+	w.inSegment = false
+}
+
+// byteOffset returns the file offset of a sample, or 0 when the output
+// format is compressed and samples have no fixed position
+func (w *voiceStreamWriter) byteOffset(sample int) int64 {
+	bytesPerSample := w.outputFormat.bytesPerSample()
+	if bytesPerSample == 0 {
+		return 0
+	}
+	return wavHeaderSize + int64(sample)*int64(bytesPerSample)
+}
+
+// writeSilence appends the given number of zero samples to the output
+func (w *voiceStreamWriter) writeSilence(count int) error {
+	for count > 0 {
+		if w.silence == nil {
+			w.silence = make([]float32, silenceChunkSamples)
+		}
+
+		n := min(count, silenceChunkSamples)
+		if err := w.writeSamples(w.silence[:n]); err != nil {
+			return err
+		}
+		count -= n
+	}
+
+	return nil
+}
+
+func (w *voiceStreamWriter) writeSamples(samples []float32) error {
+	if err := w.sink.Write(samples); err != nil {
+		return err
+	}
+
+	w.sampleCount += len(samples)
 	return nil
 }
 
@@ -356,19 +732,21 @@ func (w *voiceStreamWriter) Close() error {
 	w.closeComplete = true
 
 	var closeErr error
-	if w.encoder != nil {
-		closeErr = w.encoder.Close()
-	}
-	if w.file != nil {
-		if err := w.file.Close(); closeErr == nil && err != nil {
-			closeErr = err
-		}
+	if w.sink != nil {
+		closeErr = w.sink.Close()
 	}
 
 	if w.packetCount > 0 {
 		log.Printf("Streamed %d packets / %d samples to %s (%d decode errors)",
 			w.packetCount, w.sampleCount, w.outputPath, w.decodeErrors)
 	}
+	if loss := w.frameLoss(); loss != (decoder.LossStats{}) {
+		log.Printf("Lost Steam voice frames in %s: %d recovered with FEC, %d concealed, %d late",
+			w.outputPath, loss.Recovered, loss.Concealed, loss.Late)
+	}
+	for sectionType, count := range w.skipped {
+		log.Printf("Skipped %d Steam voice sections of type 0x%02x in %s", count, byte(sectionType), w.outputPath)
+	}
 
 	return closeErr
 }
@@ -398,20 +776,60 @@ func countVoiceWritersWithAudio(writers map[string]*voiceStreamWriter) int {
 	return count
 }
 
+// playerTeam returns the current side of the player with the given SteamID64
+func playerTeam(parser dem.Parser, steamID uint64) common.Team {
+	for _, player := range parser.GameState().Participants().All() {
+		if player.SteamID64 == steamID {
+			return player.Team
+		}
+	}
+	return common.TeamUnassigned
+}
+
+// teamName returns the short name of a side as used in exported metadata
+func teamName(team common.Team) string {
+	switch team {
+	case common.TeamTerrorists:
+		return "T"
+	case common.TeamCounterTerrorists:
+		return "CT"
+	case common.TeamSpectators:
+		return "Spectator"
+	}
+	return ""
+}
+
+// saveVoiceIndex writes the per-utterance segment index for all players with audio
+func saveVoiceIndex(demoID, outputID string, writers map[string]*voiceStreamWriter) error {
+	index := &storage.VoiceIndex{DemoID: demoID}
+	for steamID, writer := range writers {
+		if writer.sampleCount == 0 {
+			continue
+		}
 
-// saveTeamMetadata updates the metadata with team information from the demo
-func saveTeamMetadata(demoID string, playerTeams map[string]int) error {
-	metadata, err := metadataStore.LoadMetadata(demoID)
-	if err != nil {
-		log.Printf("Warning: Could not load metadata to update teams: %v", err)
-		return nil // Don't fail the whole process
+		index.Players = append(index.Players, storage.PlayerVoiceIndex{
+			SteamID:    steamID,
+			Name:       writer.playerName,
+			AudioFile:  filepath.Base(writer.outputPath),
+			SampleRate: writer.sampleRate,
+			Segments:   writer.segments,
+		})
 	}
 
+	sort.Slice(index.Players, func(i, j int) bool {
+		return index.Players[i].SteamID < index.Players[j].SteamID
+	})
+
+	return metadataStore.SaveVoiceIndex(outputID, index)
+}
+
+// applyProcessResult updates the metadata with team and round information from the demo
+func applyProcessResult(metadata *storage.DemoMetadata, result *ProcessResult) {
 	// Update players with team information from demo
 	// Team 2 = Terrorists, Team 3 = Counter-Terrorists in CS2
 	for i := range metadata.Players {
 		player := &metadata.Players[i]
-		if teamNum, exists := playerTeams[player.SteamID]; exists {
+		if teamNum, exists := result.PlayerTeams[player.SteamID]; exists {
 			switch teamNum {
 			case 2:
 				player.Team = "Team 1" // Terrorists
@@ -423,17 +841,22 @@ func saveTeamMetadata(demoID string, playerTeams map[string]int) error {
 		}
 	}
 
-	// Save updated metadata back
-	return metadataStore.UpdateMetadata(metadata)
-}
+	for i := range metadata.Players {
+		metadata.Players[i].DecodeErrors = result.DecodeErrors[metadata.Players[i].SteamID]
+		loss := result.FrameLoss[metadata.Players[i].SteamID]
+		metadata.Players[i].RecoveredFrames = loss.Recovered
+		metadata.Players[i].ConcealedFrames = loss.Concealed
+	}
 
-// Helper function to clean up old files related to the same demo
-func cleanupOldDemoFiles(demoID string) {
-	// Delete the old metadata file if it exists
-	metadataPath := filepath.Join(outputDir, demoID+".json")
-	os.Remove(metadataPath)
+	metadata.Rounds = result.Rounds
+	metadata.Warnings = result.Warnings
+}
 
-	// Delete old WAV files from this demo
+// Helper function to clean up old files written under the same output ID
+// The metadata itself is kept: it tracks the demo's status and processing
+// history and is rewritten once processing finishes.
+func cleanupOldDemoFiles(outputID string) {
+	// Delete old audio files from this demo, including round clips and mixdowns
 	files, err := os.ReadDir(outputDir)
 	if err != nil {
 		log.Printf("Error reading output directory: %v", err)
@@ -441,14 +864,31 @@ func cleanupOldDemoFiles(demoID string) {
 	}
 
 	for _, file := range files {
-		if !file.IsDir() && strings.Contains(file.Name(), "_"+demoID+".wav") {
+		if !file.IsDir() && isDemoAudioFile(file.Name(), outputID) {
 			os.Remove(filepath.Join(outputDir, file.Name()))
 		}
 	}
 
-	// Delete chat logs
-	os.Remove(filepath.Join(outputDir, demoID+"_chat.txt"))
+	// Delete chat logs and the segment index
+	os.Remove(filepath.Join(outputDir, outputID+"_chat.txt"))
+	os.Remove(filepath.Join(outputDir, storage.ChatLogJSONFilename(outputID)))
+
+	// Delete subtitle tracks
+	vttName, srtName := storage.SubtitleFilenames(outputID)
+	os.Remove(filepath.Join(outputDir, vttName))
+	os.Remove(filepath.Join(outputDir, srtName))
+	os.Remove(filepath.Join(outputDir, storage.SegmentIndexFilename(outputID)))
 
-	log.Printf("Cleaned up old files for demo ID: %s", demoID)
+	log.Printf("Cleaned up old files for output ID: %s", outputID)
 }
 
+// isDemoAudioFile reports whether an output file is audio written for the demo:
+// <steamid>_<demoID>.<ext>, <steamid>_<demoID>_r<N>.<ext> or <demoID>_mix*.<ext>
+func isDemoAudioFile(name, demoID string) bool {
+	if !storage.IsAudioFile(name) {
+		return false
+	}
+	return strings.Contains(name, "_"+demoID+".") ||
+		strings.Contains(name, "_"+demoID+"_") ||
+		strings.HasPrefix(name, demoID+"_")
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"demovoice/decoder"
+)
+
+func TestSteamSilenceSegments(t *testing.T) {
+	const sampleRate = 24000
+	frameTime := time.Duration(decoder.FrameSize) * time.Second / sampleRate
+
+	tests := []struct {
+		name          string
+		tickAligned   bool
+		silenceFrames int
+		segments      int
+	}{
+		{name: "short pause keeps the utterance", silenceFrames: 5, segments: 1},
+		{name: "short pause on a tick-aligned track", tickAligned: true, silenceFrames: 5, segments: 1},
+		{name: "pause of segmentGap ends the utterance", silenceFrames: int(segmentGap / frameTime), segments: 2},
+		{name: "long pause on a tick-aligned track", tickAligned: true, silenceFrames: 50, segments: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := ProcessOptions{Format: FormatWAV16, TickAligned: tt.tickAligned}
+			w := newVoiceStreamWriter("76561197960265728", filepath.Join(t.TempDir(), "voice.wav"), opts)
+			defer w.Close()
+
+			// The next packet arrives well within segmentGap, so only the
+			// silence section can split the utterance
+			pcm := make([]float32, decoder.FrameSize)
+			if err := w.writePCM(sampleRate, pcm, demoPosition{Tick: 64, Time: time.Second}); err != nil {
+				t.Fatalf("writePCM: %v", err)
+			}
+			if err := w.writeSteamSilence(tt.silenceFrames, sampleRate); err != nil {
+				t.Fatalf("writeSteamSilence: %v", err)
+			}
+			if err := w.writePCM(sampleRate, pcm, demoPosition{Tick: 70, Time: time.Second + 100*time.Millisecond}); err != nil {
+				t.Fatalf("writePCM: %v", err)
+			}
+
+			if len(w.segments) != tt.segments {
+				t.Errorf("got %d segments, want %d", len(w.segments), tt.segments)
+			}
+		})
+	}
+}
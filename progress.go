@@ -0,0 +1,115 @@
+package main
+
+import (
+	"demovoice/storage"
+	"sync"
+	"time"
+)
+
+// progressInterval limits how often parsing progress is published
+const progressInterval = time.Second
+
+// ProgressEvent is a processing update streamed to /events subscribers
+type ProgressEvent struct {
+	DemoID        string                   `json:"demo_id"`
+	Status        string                   `json:"status"`                   // downloading, queued, parsing, enriching, completed or failed
+	Percent       float64                  `json:"percent,omitempty"`        // Parsing progress, 0-100
+	QueuePosition int                      `json:"queue_position,omitempty"` // Position in the processing queue while queued
+	Packets       map[string]int           `json:"packets,omitempty"`        // Voice packets received so far by SteamID64
+	Error         *storage.ProcessingError `json:"error,omitempty"`          // Why processing failed
+}
+
+// Done reports whether the event is the last one for the demo
+func (e ProgressEvent) Done() bool {
+	return e.Status == "completed" || e.Status == "failed"
+}
+
+// progressStage returns the event status of a demo's metadata status. The
+// metadata calls the parsing stage "processing".
+func progressStage(status string) string {
+	if status == "processing" {
+		return "parsing"
+	}
+	return status
+}
+
+// progressHub fans out processing updates to subscribers of each demo and
+// remembers the latest update of demos that are still in progress
+type progressHub struct {
+	mu          sync.Mutex
+	latest      map[string]ProgressEvent
+	subscribers map[string]map[chan ProgressEvent]struct{}
+}
+
+var progress = newProgressHub()
+
+func newProgressHub() *progressHub {
+	return &progressHub{
+		latest:      make(map[string]ProgressEvent),
+		subscribers: make(map[string]map[chan ProgressEvent]struct{}),
+	}
+}
+
+// Publish sends an update to the demo's subscribers. Slow subscribers miss
+// intermediate updates rather than blocking processing, but always get the
+// final one so their stream can end.
+func (h *progressHub) Publish(event ProgressEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if event.Done() {
+		delete(h.latest, event.DemoID)
+	} else {
+		h.latest[event.DemoID] = event
+	}
+
+	for ch := range h.subscribers[event.DemoID] {
+		select {
+		case ch <- event:
+		default:
+			if !event.Done() {
+				continue
+			}
+			// Drop the oldest update to make room. Only Publish sends, under
+			// the lock, so the freed slot can't be taken.
+			select {
+			case <-ch:
+			default:
+			}
+			ch <- event
+		}
+	}
+}
+
+// PublishStatus sends a state transition without parsing details
+func (h *progressHub) PublishStatus(demoID, status string) {
+	h.Publish(ProgressEvent{DemoID: demoID, Status: status})
+}
+
+// Subscribe returns a channel of updates for a demo, the latest update if the
+// demo is in progress, and a function to unsubscribe
+func (h *progressHub) Subscribe(demoID string) (<-chan ProgressEvent, *ProgressEvent, func()) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	ch := make(chan ProgressEvent, 16)
+	if h.subscribers[demoID] == nil {
+		h.subscribers[demoID] = make(map[chan ProgressEvent]struct{})
+	}
+	h.subscribers[demoID][ch] = struct{}{}
+
+	var latest *ProgressEvent
+	if event, exists := h.latest[demoID]; exists {
+		latest = &event
+	}
+
+	return ch, latest, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+
+		delete(h.subscribers[demoID], ch)
+		if len(h.subscribers[demoID]) == 0 {
+			delete(h.subscribers, demoID)
+		}
+	}
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"demovoice/api"
+	"demovoice/storage"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Defaults for the processing queue, overridable with PROCESSING_WORKERS and
+// PROCESSING_BACKLOG. Each running parse holds a large read buffer and message
+// queue, so only a couple of demos are processed at once.
+const (
+	defaultProcessingWorkers = 2
+	defaultProcessingBacklog = 20
+)
+
+// ErrQueueFull is returned when the processing backlog is full
+var ErrQueueFull = errors.New("processing queue is full, try again later")
+
+// processingJob is a demo on disk waiting to be extracted
+type processingJob struct {
+	DemoID      string
+	DemoPath    string
+	Filename    string
+	MatchID     string
+	MatchData   *api.MatchResponse // Prefetched match data used to enrich players
+	Options     ProcessOptions
+	Callback    *webhookTarget // Notified when processing finishes
+	Reprocess   bool           // DemoPath is the retained source of an already processed demo
+	OutputID    string         // Filename prefix of the run's outputs, set when it starts
+	ContentHash string         // Hash of the uploaded demo, used to find duplicates
+}
+
+// jobQueue runs processing jobs in FIFO order on a fixed number of workers
+type jobQueue struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	pending []*processingJob
+	backlog int
+	run     func(*processingJob)
+}
+
+func newJobQueue(workers, backlog int, run func(*processingJob)) *jobQueue {
+	q := &jobQueue{backlog: backlog, run: run}
+	q.cond = sync.NewCond(&q.mu)
+
+	for i := 0; i < workers; i++ {
+		go q.worker()
+	}
+
+	log.Printf("Processing queue: %d worker(s), backlog of %d", workers, backlog)
+	return q
+}
+
+// Full reports whether a new job would currently be rejected
+func (q *jobQueue) Full() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.pending) >= q.backlog
+}
+
+// Enqueue adds a job to the end of the queue and returns its 1-based position
+func (q *jobQueue) Enqueue(job *processingJob) (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.pending) >= q.backlog {
+		return 0, ErrQueueFull
+	}
+
+	q.pending = append(q.pending, job)
+	q.cond.Signal()
+	return len(q.pending), nil
+}
+
+// Position returns the 1-based queue position of a demo, or 0 when it is not
+// waiting in the queue
+func (q *jobQueue) Position(demoID string) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for i, job := range q.pending {
+		if job.DemoID == demoID {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+func (q *jobQueue) worker() {
+	for {
+		q.mu.Lock()
+		for len(q.pending) == 0 {
+			q.cond.Wait()
+		}
+		job := q.pending[0]
+		q.pending[0] = nil
+		q.pending = q.pending[1:]
+		waiting := make([]string, len(q.pending))
+		for i, pending := range q.pending {
+			waiting[i] = pending.DemoID
+		}
+		q.mu.Unlock()
+
+		// Everyone behind the job moved up one place
+		for i, demoID := range waiting {
+			progress.Publish(ProgressEvent{DemoID: demoID, Status: "queued", QueuePosition: i + 1})
+		}
+
+		q.run(job)
+	}
+}
+
+// enqueueJob marks a demo as queued and adds it to the processing queue. When
+// the queue is full the demo is marked failed and its source file removed.
+func enqueueJob(metadata *storage.DemoMetadata, job *processingJob) (int, error) {
+	metadata.Status = "queued"
+	metadataStore.UpdateMetadata(metadata)
+
+	position, err := jobs.Enqueue(job)
+	if err != nil {
+		markDemoFailed(job.DemoID, err)
+		os.Remove(job.DemoPath)
+		return 0, err
+	}
+	progress.Publish(ProgressEvent{DemoID: job.DemoID, Status: "queued", QueuePosition: position})
+
+	log.Printf("Queued demo %s at position %d", job.DemoID, position)
+	return position, nil
+}
+
+// envInt reads a positive integer from the environment, falling back to def
+func envInt(name string, def int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 {
+		log.Printf("Warning: Invalid %s %q, using %d", name, value, def)
+		return def
+	}
+	return n
+}
+
+// runProcessingJob extracts a queued demo and notifies the client's webhook,
+// if any, of the outcome
+func runProcessingJob(job *processingJob) {
+	version := startRun(job)
+	job.OutputID = storage.RunOutputID(job.DemoID, version)
+	progress.PublishStatus(job.DemoID, "parsing")
+
+	// Register uploads for cleanup in case processing never returns
+	if !job.Reprocess {
+		registerUploadedDemo(filepath.Base(job.DemoPath))
+	}
+
+	log.Printf("Processing demo %s (%s) version %d", job.DemoID, job.Filename, version)
+
+	metadata, err := processJob(job)
+	if err != nil {
+		log.Printf("❌ Error processing demo %s: %v", job.DemoID, err)
+		metadata, _ = metadataStore.LoadMetadata(job.DemoID)
+		if metadata != nil {
+			metadata.Status = "failed"
+			metadata.Error = processingError(err)
+		}
+	} else {
+		metadata.Status = "completed"
+	}
+
+	// Keep the source so the demo can be reprocessed with other options
+	if metadata != nil {
+		metadata.Source = retainSource(job)
+		finishRun(metadata, version, err)
+		metadataStore.UpdateMetadata(metadata)
+
+		// Start the cleanup clock once the run is over, so a long queue or run
+		// doesn't expire the metadata while the demo is still being processed
+		registerDemoOutputs(metadata)
+	} else {
+		os.Remove(job.DemoPath)
+	}
+
+	if err != nil {
+		progress.Publish(ProgressEvent{DemoID: job.DemoID, Status: "failed", Error: processingError(err)})
+	} else {
+		progress.PublishStatus(job.DemoID, "completed")
+		log.Printf("✅ Demo processing complete: %s", job.DemoID)
+	}
+
+	if job.Callback != nil {
+		notifyWebhook(job.Callback, job.DemoID, metadata, err)
+	}
+	notifyWaitingCallbacks(job.DemoID, metadata, err)
+}
+
+// processJob runs ProcessDemo, saves the demo's metadata and enriches the
+// players with Faceit data
+func processJob(job *processingJob) (*storage.DemoMetadata, error) {
+	result, err := ProcessDemo(job.DemoPath, job.DemoID, job.OutputID, job.Options)
+	if err != nil {
+		return nil, err
+	}
+
+	// Record the outputs in the existing metadata, which keeps the processing
+	// history, options, content hash and source of the demo
+	metadata, err := metadataStore.LoadMetadata(job.DemoID)
+	if err != nil {
+		metadata = &storage.DemoMetadata{DemoID: job.DemoID, Filename: job.Filename}
+	}
+	if err := metadataStore.ScanOutputs(metadata, job.OutputID); err != nil {
+		return nil, withCode(ErrCodeMetadata, fmt.Errorf("failed to scan outputs: %w", err))
+	}
+
+	// Outputs expire tempFileLifetime after they are written, and the demo
+	// can be reused for as long
+	metadata.UploadTime = time.Now()
+
+	// Outputs are on disk; keep the demo in progress until players are enriched
+	metadata.Status = "enriching"
+	if err := metadataStore.UpdateMetadata(metadata); err != nil {
+		return nil, withCode(ErrCodeMetadata, fmt.Errorf("failed to save metadata: %w", err))
+	}
+	progress.PublishStatus(job.DemoID, "enriching")
+
+	// Fall back to the match ID of the job, e.g. from a match URL
+	if metadata.MatchID == "" {
+		metadata.MatchID = job.MatchID
+	}
+
+	// Add team and round information now that metadata exists
+	applyProcessResult(metadata, result)
+
+	// Fetch match data if it was not prefetched
+	matchData := job.MatchData
+	if matchData == nil && metadata.MatchID != "" {
+		log.Printf("Fetching match data for demo %s with match ID: %s", job.DemoID, metadata.MatchID)
+		md, err := faceitClient.GetMatchData(metadata.MatchID)
+		if err != nil {
+			log.Printf("Warning: Failed to fetch match data for demo %s: %v", job.DemoID, err)
+		}
+		matchData = md
+	}
+
+	// Use match data to enrich players
+	if matchData != nil {
+		matchDataBytes, _ := json.Marshal(matchData)
+		metadata.MatchDataJSON = string(matchDataBytes)
+		metadata.Players = faceitClient.EnrichPlayersFromMatch(metadata.Players, matchData)
+	}
+
+	// Enrich player data with Faceit information (nickname, ELO, level)
+	// Fallback to individual API calls if nickname is still missing
+	for i := range metadata.Players {
+		if metadata.Players[i].Nickname == "" {
+			if err := faceitClient.EnrichPlayerInfo(&metadata.Players[i]); err != nil {
+				log.Printf("Warning: Failed to enrich player %s: %v", metadata.Players[i].SteamID, err)
+			}
+		}
+	}
+
+	// Subtitles use the enriched nicknames
+	if err := metadataStore.WriteSubtitles(metadata); err != nil {
+		log.Printf("Warning: Failed to write subtitles: %v", err)
+	}
+
+	return metadata, nil
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"demovoice/storage"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	sourceDir       string             // Retained source demos, named <demoID>.dem[.zst]
+	sourceRetention = tempFileLifetime // How long sources are kept after processing
+	reprocessMutex  sync.Mutex         // Makes checking and queueing a reprocess atomic
+)
+
+// runOptions converts extraction options to the form recorded in metadata
+func runOptions(opts ProcessOptions) storage.RunOptions {
+	return storage.RunOptions{
+		ChatOnly:    opts.ChatOnly,
+		TickAligned: opts.TickAligned,
+		Mixdown:     opts.Mixdown,
+		SplitRounds: opts.SplitRounds,
+		Format:      string(opts.Format),
+	}
+}
+
+// dedupOptions normalizes extraction options for finding duplicate demos:
+// the default format is filled in and chat-only runs ignore the voice options
+func dedupOptions(opts ProcessOptions) storage.RunOptions {
+	if opts.ChatOnly {
+		return storage.RunOptions{ChatOnly: true}
+	}
+	if opts.Format == "" {
+		opts.Format = FormatWAV32
+	}
+	return runOptions(opts)
+}
+
+// processOptions converts recorded options back to extraction options
+func processOptions(opts storage.RunOptions) ProcessOptions {
+	return ProcessOptions{
+		ChatOnly:    opts.ChatOnly,
+		TickAligned: opts.TickAligned,
+		Mixdown:     opts.Mixdown,
+		SplitRounds: opts.SplitRounds,
+		Format:      OutputFormat(opts.Format),
+	}
+}
+
+// startRun marks a demo as processing and records a new run in its history,
+// returning the run's version
+func startRun(job *processingJob) int {
+	metadata, err := metadataStore.LoadMetadata(job.DemoID)
+	if err != nil {
+		return 1
+	}
+
+	if job.Options.Format == "" {
+		job.Options.Format = FormatWAV32
+	}
+
+	metadata.Version++
+	metadata.Status = "processing"
+	metadata.Error = nil
+	metadata.Options = dedupOptions(job.Options)
+	metadata.Runs = append(metadata.Runs, storage.ProcessingRun{
+		Version:   metadata.Version,
+		Options:   runOptions(job.Options),
+		Status:    "processing",
+		StartedAt: time.Now(),
+	})
+	metadataStore.UpdateMetadata(metadata)
+
+	return metadata.Version
+}
+
+// finishRun records the outcome and output files of a run in the demo's history
+func finishRun(metadata *storage.DemoMetadata, version int, err error) {
+	metadata.Version = version
+	for i := range metadata.Runs {
+		run := &metadata.Runs[i]
+		if run.Version != version {
+			continue
+		}
+
+		run.FinishedAt = time.Now()
+		run.Status = "completed"
+		run.Files = metadata.OutputFiles()
+		if err != nil {
+			run.Status = "failed"
+			run.Error = processingError(err)
+			run.Files = nil
+		}
+	}
+}
+
+// retainSource moves a processed demo into the source directory so it can be
+// reprocessed during the retention window, and returns its name there. The
+// demo is deleted instead when retention is disabled.
+func retainSource(job *processingJob) string {
+	if sourceDir == "" || sourceRetention <= 0 {
+		os.Remove(job.DemoPath)
+		return ""
+	}
+
+	// ProcessDemo detects compression from the extension, so keep it
+	name := job.DemoID + ".dem"
+	if strings.HasSuffix(strings.ToLower(job.DemoPath), ".zst") {
+		name += ".zst"
+	}
+
+	path := filepath.Join(sourceDir, name)
+	if job.DemoPath != path {
+		if err := os.Rename(job.DemoPath, path); err != nil {
+			log.Printf("Warning: Failed to retain source of demo %s: %v", job.DemoID, err)
+			os.Remove(job.DemoPath)
+			return ""
+		}
+	}
+
+	// The retention window starts again after each run
+	now := time.Now()
+	os.Chtimes(path, now, now)
+	return name
+}
+
+// cleanupExpiredSources deletes retained source demos older than the retention window
+func cleanupExpiredSources() {
+	files, err := os.ReadDir(sourceDir)
+	if err != nil {
+		return
+	}
+
+	for _, file := range files {
+		info, err := file.Info()
+		if err != nil || file.IsDir() || time.Since(info.ModTime()) <= sourceRetention {
+			continue
+		}
+
+		if err := os.Remove(filepath.Join(sourceDir, file.Name())); err == nil {
+			log.Printf("Deleted retained source demo: %s", file.Name())
+		}
+	}
+}
+
+// handleReprocess reruns extraction of an already processed demo from its
+// retained source, with the options given as query parameters
+func handleReprocess(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w)
+	key, ok := authorizeAPIRequest(w, r, storage.ScopeUpload)
+	if !ok {
+		return
+	}
+
+	opts, err := processOptionsFromRequest(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	callback, err := webhookTargetFromRequest(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	demoID := r.PathValue("id")
+	position, status, err := queueReprocess(demoID, key, opts, callback)
+	if err != nil {
+		writeJSONError(w, status, err.Error())
+		return
+	}
+
+	log.Printf("🔁 Reprocessing demo %s (queue position %d)", demoID, position)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(APIUploadResponse{
+		Success:       true,
+		DemoID:        demoID,
+		Status:        "queued",
+		QueuePosition: position,
+		ChatOnly:      opts.ChatOnly,
+		TickAligned:   opts.TickAligned,
+		Mixdown:       opts.Mixdown,
+		SplitRounds:   opts.SplitRounds,
+		Format:        string(opts.Format),
+		AccessToken:   demoAccessToken(demoID),
+	})
+}
+
+// queueReprocess queues a rerun of a demo from its retained source. The
+// demo's state is checked and changed under reprocessMutex, so concurrent
+// requests can't queue it twice. On failure it returns the HTTP status to
+// answer with.
+func queueReprocess(demoID string, key *storage.APIKey, opts ProcessOptions, callback *webhookTarget) (int, int, error) {
+	reprocessMutex.Lock()
+	defer reprocessMutex.Unlock()
+
+	metadata, err := metadataStore.LoadMetadata(demoID)
+	if err != nil {
+		return 0, http.StatusNotFound, errors.New("Demo not found")
+	}
+
+	if demoInProgress(metadata) {
+		return 0, http.StatusConflict, errors.New("Demo is still being processed")
+	}
+
+	sourcePath := filepath.Join(sourceDir, metadata.Source)
+	if _, err := os.Stat(sourcePath); metadata.Source == "" || err != nil {
+		return 0, http.StatusGone, errors.New("Source demo is no longer available, upload it again")
+	}
+
+	if err := chargeDemoQuota(key); err != nil {
+		return 0, http.StatusTooManyRequests, err
+	}
+
+	// Queue the job only after the status change so a worker can't pick it
+	// up first and have its "processing" status overwritten
+	// Uploads of the same demo with the new options reuse this run
+	previousStatus, previousOptions := metadata.Status, metadata.Options
+	metadata.Status = "queued"
+	metadata.Options = dedupOptions(opts)
+	metadataStore.UpdateMetadata(metadata)
+
+	job := &processingJob{
+		DemoID:    demoID,
+		DemoPath:  sourcePath,
+		Filename:  metadata.Filename,
+		MatchID:   metadata.MatchID,
+		Options:   opts,
+		Callback:  callback,
+		Reprocess: true,
+	}
+	position, err := jobs.Enqueue(job)
+	if err != nil {
+		metadata.Status, metadata.Options = previousStatus, previousOptions
+		metadataStore.UpdateMetadata(metadata)
+		refundDemoQuota(key)
+		return 0, http.StatusServiceUnavailable, err
+	}
+	progress.Publish(ProgressEvent{DemoID: demoID, Status: "queued", QueuePosition: position})
+	return position, 0, nil
+}
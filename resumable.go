@@ -0,0 +1,470 @@
+package main
+
+import (
+	"crypto/sha256"
+	"demovoice/storage"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Resumable uploads follow the tus 1.0 protocol (core, creation, expiration
+// and termination), so tus clients can upload large demos in chunks and
+// resume after a dropped connection.
+const (
+	tusVersion              = "1.0.0"
+	tusExtensions           = "creation,expiration,termination"
+	resumableUploadLifetime = 24 * time.Hour // Unfinished uploads are deleted after this
+	statusChecksumMismatch  = 460            // tus checksum extension status code
+)
+
+var uploadStore *storage.UploadStore // Resumable uploads in progress
+
+// UploadResource is a resumable upload as returned by GET /api/v1/uploads/{id}
+type UploadResource struct {
+	ID          string    `json:"id"`
+	Filename    string    `json:"filename"`
+	Length      int64     `json:"length"`
+	Offset      int64     `json:"offset"`
+	Status      string    `json:"status"` // "uploading", "verifying", "completed" or "failed"
+	DemoID      string    `json:"demo_id,omitempty"`
+	AccessToken string    `json:"access_token,omitempty"` // Reads the demo without a key
+	Error       string    `json:"error,omitempty"`
+	ErrorCode   string    `json:"error_code,omitempty"` // "checksum_mismatch", "bad_request", "quota_exceeded", "queue_full" or "internal_error"
+	ExpiresAt   time.Time `json:"expires_at"`
+}
+
+// handleTusOptions advertises the supported tus version and extensions
+func handleTusOptions(w http.ResponseWriter, r *http.Request) {
+	setAPIv1CORSHeaders(w)
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", tusExtensions)
+	w.Header().Set("Tus-Max-Size", strconv.FormatInt(maxUploadSize, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// parseUploadMetadata decodes the tus Upload-Metadata header: comma-separated
+// keys, each followed by a space and a base64 value
+func parseUploadMetadata(header string) (map[string]string, error) {
+	metadata := make(map[string]string)
+	for _, pair := range strings.Split(header, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		key, encoded, _ := strings.Cut(pair, " ")
+		value, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("invalid Upload-Metadata value for %q", key)
+		}
+		metadata[key] = string(value)
+	}
+	return metadata, nil
+}
+
+// parseChecksum accepts "sha256:<hex>" or "sha256 <hex>"
+func parseChecksum(value string) (string, error) {
+	algorithm, sum, found := strings.Cut(strings.Replace(value, " ", ":", 1), ":")
+	if !found || !strings.EqualFold(algorithm, "sha256") {
+		return "", errors.New("checksum must be sha256:<hex>")
+	}
+	if decoded, err := hex.DecodeString(sum); err != nil || len(decoded) != sha256.Size {
+		return "", errors.New("checksum must be sha256:<hex>")
+	}
+	return "sha256:" + strings.ToLower(sum), nil
+}
+
+// setTusHeaders writes the headers describing an upload's state
+func setTusHeaders(w http.ResponseWriter, upload *storage.ResumableUpload, offset int64) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	w.Header().Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	if upload.DemoID != "" {
+		w.Header().Set("X-Demo-ID", upload.DemoID)
+	}
+}
+
+// uploadOffset returns how much of an upload has been received
+func uploadOffset(upload *storage.ResumableUpload) int64 {
+	if upload.Status == "verifying" || upload.Status == "completed" {
+		return upload.Length
+	}
+	offset, _ := uploadStore.Offset(upload.ID)
+	return offset
+}
+
+// loadUploadOr404 loads the upload named in the path if the request's key may access it
+func loadUploadOr404(w http.ResponseWriter, r *http.Request) (*storage.ResumableUpload, bool) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	if version := r.Header.Get("Tus-Resumable"); version != "" && version != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		writeAPIError(w, http.StatusPreconditionFailed, "bad_request", "Unsupported tus version "+version)
+		return nil, false
+	}
+
+	upload, err := uploadStore.Load(r.PathValue("id"))
+	key := apiKeyFromContext(r)
+	if err != nil || (key != nil && upload.KeyID != key.ID && !key.HasScope(storage.ScopeAdmin)) {
+		writeAPIError(w, http.StatusNotFound, "not_found", "Upload not found")
+		return nil, false
+	}
+	return upload, true
+}
+
+// handleCreateUpload starts a resumable upload. The size goes in
+// Upload-Length and the filename (plus an optional sha256 checksum of the
+// whole file) in Upload-Metadata. Extraction options are query parameters.
+func handleCreateUpload(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	if version := r.Header.Get("Tus-Resumable"); version != "" && version != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		writeAPIError(w, http.StatusPreconditionFailed, "bad_request", "Unsupported tus version "+version)
+		return
+	}
+
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length <= 0 {
+		writeAPIError(w, http.StatusBadRequest, "bad_request", "Upload-Length must be a positive number of bytes")
+		return
+	}
+	if length > maxUploadSize {
+		w.Header().Set("Tus-Max-Size", strconv.FormatInt(maxUploadSize, 10))
+		writeAPIError(w, http.StatusRequestEntityTooLarge, "too_large", ErrDemoTooLarge.Error())
+		return
+	}
+
+	metadata, err := parseUploadMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "bad_request", err.Error())
+		return
+	}
+	filename := filepath.Base(metadata["filename"])
+	if metadata["filename"] == "" || filename == "." || filename == string(filepath.Separator) {
+		writeAPIError(w, http.StatusBadRequest, "bad_request", "Upload-Metadata must include a filename")
+		return
+	}
+
+	var checksum string
+	if metadata["checksum"] != "" {
+		checksum, err = parseChecksum(metadata["checksum"])
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, "bad_request", err.Error())
+			return
+		}
+	}
+
+	opts, err := processOptionsFromRequest(r)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "bad_request", err.Error())
+		return
+	}
+	callback, err := webhookTargetFromRequest(r)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "bad_request", err.Error())
+		return
+	}
+
+	// Don't let a client upload hundreds of megabytes it can't process
+	key := apiKeyFromContext(r)
+	if quotaExhausted(key) {
+		writeAPIError(w, http.StatusTooManyRequests, "quota_exceeded", errQuotaExceeded.Error())
+		return
+	}
+
+	upload := &storage.ResumableUpload{
+		Filename:  filename,
+		Length:    length,
+		Checksum:  checksum,
+		Options:   runOptions(opts),
+		ExpiresAt: time.Now().Add(resumableUploadLifetime),
+	}
+	if key != nil {
+		upload.KeyID = key.ID
+	}
+	if callback != nil {
+		upload.Callback = &storage.UploadHook{URL: callback.URL, Secret: callback.Secret, BaseURL: callback.BaseURL}
+	}
+
+	if err := uploadStore.Create(upload); err != nil {
+		log.Printf("Error creating upload: %v", err)
+		writeAPIError(w, http.StatusInternalServerError, "internal_error", "Failed to create upload")
+		return
+	}
+
+	log.Printf("📥 Resumable upload %s started: %s (%d bytes)", upload.ID, filename, length)
+
+	setTusHeaders(w, upload, 0)
+	w.Header().Set("Location", "/api/v1/uploads/"+upload.ID)
+	writeAPIJSON(w, http.StatusCreated, newUploadResource(upload))
+}
+
+// handleGetUpload returns the offset of an upload in tus headers (HEAD) and,
+// for GET, its state as JSON including the demo ID once it is complete
+func handleGetUpload(w http.ResponseWriter, r *http.Request) {
+	upload, ok := loadUploadOr404(w, r)
+	if !ok {
+		return
+	}
+
+	setTusHeaders(w, upload, uploadOffset(upload))
+	w.Header().Set("Cache-Control", "no-store")
+	if r.Method == http.MethodHead {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	writeAPIJSON(w, http.StatusOK, newUploadResource(upload))
+}
+
+// handlePatchUpload appends a chunk at the offset given in Upload-Offset.
+// The last chunk completes the upload, which is then verified and queued for
+// processing in the background; GET returns its demo ID once it is queued.
+func handlePatchUpload(w http.ResponseWriter, r *http.Request) {
+	upload, ok := loadUploadOr404(w, r)
+	if !ok {
+		return
+	}
+
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		writeAPIError(w, http.StatusUnsupportedMediaType, "bad_request", "Content-Type must be application/offset+octet-stream")
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		writeAPIError(w, http.StatusBadRequest, "bad_request", "Upload-Offset must be a non-negative number")
+		return
+	}
+	if upload.Status != "uploading" {
+		setTusHeaders(w, upload, uploadOffset(upload))
+		writeAPIError(w, http.StatusConflict, "conflict", "Upload is already "+upload.Status)
+		return
+	}
+	if time.Now().After(upload.ExpiresAt) {
+		writeAPIError(w, http.StatusGone, "not_found", "Upload has expired")
+		return
+	}
+
+	newOffset, err := uploadStore.WriteChunk(upload, offset, r.Body)
+	switch {
+	case errors.Is(err, storage.ErrUploadOffset):
+		setTusHeaders(w, upload, newOffset)
+		writeAPIError(w, http.StatusConflict, "conflict", fmt.Sprintf("Upload-Offset %d does not match the upload offset %d", offset, newOffset))
+		return
+	case errors.Is(err, storage.ErrUploadBusy):
+		writeAPIError(w, http.StatusLocked, "conflict", err.Error())
+		return
+	case errors.Is(err, storage.ErrUploadTooLarge):
+		writeAPIError(w, http.StatusRequestEntityTooLarge, "bad_request", err.Error())
+		return
+	case err != nil:
+		// Usually a dropped connection; the client resumes from the stored offset
+		log.Printf("Resumable upload %s interrupted at %d bytes: %v", upload.ID, newOffset, err)
+		writeAPIError(w, http.StatusInternalServerError, "internal_error", "Failed to store chunk")
+		return
+	}
+
+	// Reject files that aren't demos as soon as their first bytes arrive
+	if offset < int64(len(demoMagic)) && newOffset >= int64(len(demoMagic)) {
+		if _, err := checkDemoHeader(uploadStore.PartPath(upload.ID)); err != nil {
+			uploadStore.Remove(upload.ID)
+			log.Printf("❌ Resumable upload %s rejected: %v", upload.ID, err)
+			writeAPIError(w, http.StatusBadRequest, "bad_request", err.Error())
+			return
+		}
+	}
+
+	if newOffset == upload.Length {
+		finished, ok := uploadStore.Finish(upload.ID)
+		if !ok {
+			writeAPIError(w, http.StatusConflict, "conflict", "Upload is already complete")
+			return
+		}
+		*upload = *finished
+
+		// Hashing a large demo takes longer than clients wait for a chunk
+		go completeUpload(*finished)
+	}
+
+	setTusHeaders(w, upload, newOffset)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleDeleteUpload cancels an upload and deletes what was received
+func handleDeleteUpload(w http.ResponseWriter, r *http.Request) {
+	upload, ok := loadUploadOr404(w, r)
+	if !ok {
+		return
+	}
+
+	uploadStore.Remove(upload.ID)
+	log.Printf("Resumable upload %s cancelled", upload.ID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// completeUpload verifies a finished upload and queues it for processing,
+// recording the demo ID in the upload, or why it failed
+func completeUpload(upload storage.ResumableUpload) {
+	partPath := uploadStore.PartPath(upload.ID)
+
+	fail := func(status int, err error) {
+		upload.Status = "failed"
+		upload.Error = err.Error()
+		upload.ErrorCode = uploadErrorCode(status)
+		uploadStore.Save(&upload)
+		os.Remove(partPath)
+		log.Printf("❌ Resumable upload %s failed: %v", upload.ID, err)
+	}
+
+	if upload.Checksum != "" {
+		sum, err := fileChecksum(partPath)
+		if err != nil {
+			fail(http.StatusInternalServerError, fmt.Errorf("failed to verify upload: %w", err))
+			return
+		}
+		if sum != upload.Checksum {
+			fail(statusChecksumMismatch, fmt.Errorf("checksum mismatch: expected %s, got %s", upload.Checksum, sum))
+			return
+		}
+	}
+
+	ext, err := checkDemoFile(partPath)
+	if err != nil {
+		fail(uploadErrorStatus(err, http.StatusInternalServerError), err)
+		return
+	}
+	contentHash, err := fileContentHash(partPath)
+	if err != nil {
+		fail(uploadErrorStatus(err, http.StatusInternalServerError), err)
+		return
+	}
+
+	var callback *webhookTarget
+	if upload.Callback != nil {
+		callback = &webhookTarget{URL: upload.Callback.URL, Secret: upload.Callback.Secret, BaseURL: upload.Callback.BaseURL}
+	}
+
+	key := uploadKey(&upload)
+	if err := chargeDemoQuota(key); err != nil {
+		fail(http.StatusTooManyRequests, err)
+		return
+	}
+
+	job := &processingJob{
+		DemoPath:    newUploadPath(ext),
+		Filename:    upload.Filename,
+		MatchID:     storage.ExtractMatchIDFromFilename(upload.Filename),
+		Options:     processOptions(upload.Options),
+		Callback:    callback,
+		ContentHash: contentHash,
+	}
+	if err := os.Rename(partPath, job.DemoPath); err != nil {
+		refundDemoQuota(key)
+		fail(http.StatusInternalServerError, fmt.Errorf("failed to store upload: %w", err))
+		return
+	}
+
+	metadata, _, err := queueStoredDemo(job)
+	if err != nil {
+		refundDemoQuota(key)
+		fail(http.StatusServiceUnavailable, err)
+		return
+	}
+	if metadata.DemoID != job.DemoID {
+		refundDemoQuota(key)
+	}
+
+	upload.Status = "completed"
+	upload.DemoID = metadata.DemoID
+	uploadStore.Save(&upload)
+	log.Printf("✅ Resumable upload %s complete: demo %s", upload.ID, upload.DemoID)
+}
+
+// uploadKey returns the API key that created an upload, if it still exists
+func uploadKey(upload *storage.ResumableUpload) *storage.APIKey {
+	switch upload.KeyID {
+	case "":
+		return nil
+	case envAPIKey.ID:
+		return envAPIKey
+	}
+	key, err := apiKeys.Get(upload.KeyID)
+	if err != nil {
+		return nil
+	}
+	return key
+}
+
+// uploadErrorCode returns the error envelope code for a failed upload's status
+func uploadErrorCode(status int) string {
+	switch status {
+	case statusChecksumMismatch:
+		return "checksum_mismatch"
+	case http.StatusTooManyRequests:
+		return "quota_exceeded"
+	case http.StatusServiceUnavailable:
+		return ErrCodeQueueFull
+	case http.StatusConflict:
+		return "conflict"
+	case http.StatusBadRequest:
+		return "bad_request"
+	case http.StatusRequestEntityTooLarge:
+		return "too_large"
+	}
+	return "internal_error"
+}
+
+// fileChecksum returns the "sha256:<hex>" checksum of a file
+func fileChecksum(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return "sha256:" + hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func newUploadResource(upload *storage.ResumableUpload) UploadResource {
+	resource := UploadResource{
+		ID:        upload.ID,
+		Filename:  upload.Filename,
+		Length:    upload.Length,
+		Offset:    uploadOffset(upload),
+		Status:    upload.Status,
+		DemoID:    upload.DemoID,
+		Error:     upload.Error,
+		ErrorCode: upload.ErrorCode,
+		ExpiresAt: upload.ExpiresAt,
+	}
+	if upload.DemoID != "" {
+		resource.AccessToken = demoAccessToken(upload.DemoID)
+	}
+	return resource
+}
+
+// cleanupExpiredUploads deletes resumable uploads past their expiry time
+func cleanupExpiredUploads() {
+	if uploadStore == nil {
+		return
+	}
+
+	for _, upload := range uploadStore.Expired() {
+		uploadStore.Remove(upload.ID)
+		log.Printf("Deleted expired resumable upload: %s (%s)", upload.ID, upload.Filename)
+	}
+}
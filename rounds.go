@@ -0,0 +1,147 @@
+package main
+
+import (
+	"demovoice/storage"
+	"fmt"
+	"log"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/markus-wa/demoinfocs-golang/v5/pkg/demoinfocs/common"
+)
+
+// roundSplitter writes one clip per player per round, plus an optional
+// per-round mixdown, alongside the full-length tracks. A round lasts from its
+// RoundStart until the next one so that comms after the round-end are kept
+// with the round they are about.
+type roundSplitter struct {
+	outputID string // Filename prefix of the clips
+	opts     ProcessOptions
+
+	rounds    []storage.RoundInfo
+	current   *storage.RoundInfo
+	startTime time.Duration
+	clips     map[string]*voiceStreamWriter // Clips of the current round by SteamID
+	mix       *mixdownWriter
+
+	// Team states of the current round's sides, so the score can be read
+	// once it has been updated even if the sides swap at halftime
+	terrorists        *common.TeamState
+	counterTerrorists *common.TeamState
+}
+
+func newRoundSplitter(outputID string, opts ProcessOptions) *roundSplitter {
+	return &roundSplitter{
+		outputID: outputID,
+		opts:     opts,
+	}
+}
+
+// StartRound finishes the previous round and starts recording a new one
+func (s *roundSplitter) StartRound(number int, at demoPosition, terrorists, counterTerrorists *common.TeamState) error {
+	err := s.finishRound()
+
+	// A restarted round (e.g. after a technical pause) replaces its earlier record
+	if len(s.rounds) > 0 && s.rounds[len(s.rounds)-1].Number == number {
+		s.rounds = s.rounds[:len(s.rounds)-1]
+	}
+
+	s.current = &storage.RoundInfo{
+		Number:    number,
+		StartTick: at.Tick,
+		StartTime: at.Time.Seconds(),
+	}
+	s.startTime = at.Time
+	s.clips = make(map[string]*voiceStreamWriter, 10)
+	s.terrorists = terrorists
+	s.counterTerrorists = counterTerrorists
+
+	if s.opts.Mixdown {
+		path := filepath.Join(outputDir, storage.RoundMixdownFilename(s.outputID, number, s.opts.Format.Extension()))
+		s.mix = newMixdownWriter(path, s.opts.Format)
+		s.mix.origin = at.Time
+	}
+
+	return err
+}
+
+// EndRound records the winner of the current round
+func (s *roundSplitter) EndRound(at demoPosition, winner common.Team) {
+	if s.current == nil {
+		return
+	}
+
+	s.current.EndTick = at.Tick
+	s.current.EndTime = at.Time.Seconds()
+	s.current.Winner = teamName(winner)
+}
+
+// ClipFor returns the current round's clip writer for a player, or nil when
+// no round is in progress
+func (s *roundSplitter) ClipFor(steamID string) *voiceStreamWriter {
+	if s.current == nil {
+		return nil
+	}
+
+	clip, exists := s.clips[steamID]
+	if !exists {
+		path := filepath.Join(outputDir, fmt.Sprintf("%s_%s_r%d%s", steamID, s.outputID, s.current.Number, s.opts.Format.Extension()))
+		clip = newVoiceStreamWriter(steamID, path, s.opts)
+		clip.origin = s.startTime
+		clip.mix = s.mix
+		s.clips[steamID] = clip
+	}
+
+	return clip
+}
+
+// Close finishes the last round and returns all recorded rounds
+func (s *roundSplitter) Close() ([]storage.RoundInfo, error) {
+	err := s.finishRound()
+	return s.rounds, err
+}
+
+func (s *roundSplitter) finishRound() error {
+	if s.current == nil {
+		return nil
+	}
+
+	round := s.current
+	s.current = nil
+
+	if s.terrorists != nil && s.counterTerrorists != nil {
+		round.ScoreT = s.terrorists.Score()
+		round.ScoreCT = s.counterTerrorists.Score()
+	}
+
+	closeErr := closeVoiceWriters(s.clips)
+	for steamID, clip := range s.clips {
+		if clip.sampleCount == 0 {
+			continue
+		}
+		round.Clips = append(round.Clips, storage.RoundClip{
+			SteamID:     steamID,
+			AudioFile:   filepath.Base(clip.outputPath),
+			AudioLength: storage.FormatAudioLength(float64(clip.sampleCount) / float64(clip.sampleRate)),
+		})
+	}
+	sort.Slice(round.Clips, func(i, j int) bool {
+		return round.Clips[i].SteamID < round.Clips[j].SteamID
+	})
+	s.clips = nil
+
+	if s.mix != nil {
+		if err := s.mix.Close(); err != nil && closeErr == nil {
+			closeErr = fmt.Errorf("failed to close round %d mixdown: %w", round.Number, err)
+		}
+		if s.mix.sink != nil {
+			round.Mixdown = filepath.Base(s.mix.outputPath)
+		}
+		s.mix = nil
+	}
+
+	log.Printf("Round %d: %d voice clip(s), winner %q (%d-%d)", round.Number, len(round.Clips), round.Winner, round.ScoreT, round.ScoreCT)
+	s.rounds = append(s.rounds, *round)
+	return closeErr
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"demovoice/encoder"
+	"fmt"
+	"math/rand/v2"
+	"os"
+
+	"github.com/go-audio/audio"
+	"github.com/go-audio/wav"
+)
+
+// OutputFormat selects the container and sample encoding of extracted audio
+type OutputFormat string
+
+const (
+	FormatWAV32   OutputFormat = "wav32" // 32-bit PCM WAV (default)
+	FormatWAV16   OutputFormat = "wav16" // 16-bit PCM WAV
+	FormatOggOpus OutputFormat = "opus"  // Ogg Opus
+)
+
+// ParseOutputFormat validates a format name; an empty name selects the default
+func ParseOutputFormat(name string) (OutputFormat, error) {
+	switch format := OutputFormat(name); format {
+	case "":
+		return FormatWAV32, nil
+	case FormatWAV32, FormatWAV16, FormatOggOpus:
+		return format, nil
+	}
+	return "", fmt.Errorf("unknown output format %q (expected wav32, wav16 or opus)", name)
+}
+
+// Extension returns the file extension used for the format
+func (f OutputFormat) Extension() string {
+	if f == FormatOggOpus {
+		return ".ogg"
+	}
+	return ".wav"
+}
+
+// bytesPerSample returns the size of one mono sample in the file, or 0 when
+// samples do not map to fixed byte offsets
+func (f OutputFormat) bytesPerSample() int {
+	switch f {
+	case FormatWAV16:
+		return 2
+	case FormatOggOpus:
+		return 0
+	}
+	return 4
+}
+
+// audioSink encodes float PCM into an audio file
+type audioSink interface {
+	// Write appends samples, interleaved when there are several channels
+	Write(samples []float32) error
+	Close() error
+}
+
+func newAudioSink(path string, format OutputFormat, sampleRate, channels int) (audioSink, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create audio file: %w", err)
+	}
+
+	if format != FormatOggOpus {
+		bitDepth := format.bytesPerSample() * 8
+		return &wavSink{
+			file:       file,
+			encoder:    wav.NewEncoder(file, sampleRate, bitDepth, channels, 1),
+			sampleRate: sampleRate,
+			channels:   channels,
+			scale:      float32(int64(1)<<(bitDepth-1) - 1),
+		}, nil
+	}
+
+	// libopus only accepts a few input rates; resample anything else to 48 kHz
+	sink := &oggOpusSink{file: file, inputRate: sampleRate, encodeRate: sampleRate}
+	if !encoder.SupportedSampleRate(sampleRate) {
+		if channels != 1 {
+			file.Close()
+			return nil, fmt.Errorf("%w: %d Hz with %d channels", encoder.ErrUnsupportedSampleRate, sampleRate, channels)
+		}
+		sink.encodeRate = 48000
+	}
+
+	sink.writer, err = encoder.NewOggOpusWriter(file, sink.encodeRate, channels, rand.Uint32())
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to create Ogg Opus encoder: %w", err)
+	}
+
+	return sink, nil
+}
+
+// wavSink writes integer PCM WAV files via go-audio/wav
+type wavSink struct {
+	file       *os.File
+	encoder    *wav.Encoder
+	sampleRate int
+	channels   int
+	scale      float32
+	intScratch []int
+}
+
+func (s *wavSink) Write(samples []float32) error {
+	if cap(s.intScratch) < len(samples) {
+		s.intScratch = make([]int, len(samples))
+	} else {
+		s.intScratch = s.intScratch[:len(samples)]
+	}
+
+	for i, sample := range samples {
+		s.intScratch[i] = int(max(-1, min(1, sample)) * s.scale)
+	}
+
+	buf := &audio.IntBuffer{
+		Data: s.intScratch,
+		Format: &audio.Format{
+			SampleRate:  s.sampleRate,
+			NumChannels: s.channels,
+		},
+	}
+
+	if err := s.encoder.Write(buf); err != nil {
+		return fmt.Errorf("failed to write WAV data: %w", err)
+	}
+	return nil
+}
+
+func (s *wavSink) Close() error {
+	closeErr := s.encoder.Close()
+	if err := s.file.Close(); closeErr == nil && err != nil {
+		closeErr = err
+	}
+	return closeErr
+}
+
+// oggOpusSink writes Ogg Opus files, resampling when libopus does not
+// support the input rate
+type oggOpusSink struct {
+	file       *os.File
+	writer     *encoder.OggOpusWriter
+	inputRate  int
+	encodeRate int
+	resampled  []float32
+}
+
+func (s *oggOpusSink) Write(samples []float32) error {
+	if s.inputRate != s.encodeRate {
+		s.resampled = resampleLinear(samples, s.inputRate, s.encodeRate, s.resampled[:0])
+		samples = s.resampled
+	}
+	return s.writer.Write(samples)
+}
+
+func (s *oggOpusSink) Close() error {
+	closeErr := s.writer.Close()
+	if err := s.file.Close(); closeErr == nil && err != nil {
+		closeErr = err
+	}
+	return closeErr
+}
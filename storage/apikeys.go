@@ -0,0 +1,303 @@
+package storage
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// API key scopes. Admin keys may do everything.
+const (
+	ScopeUpload = "upload"
+	ScopeRead   = "read"
+	ScopeDelete = "delete"
+	ScopeAdmin  = "admin"
+)
+
+// Scopes lists every valid scope
+var Scopes = []string{ScopeUpload, ScopeRead, ScopeDelete, ScopeAdmin}
+
+// ErrAPIKeyNotFound is returned for unknown or revoked keys
+var ErrAPIKeyNotFound = errors.New("API key not found")
+
+// APIKey is a registered API client. Only a hash of the secret is stored.
+type APIKey struct {
+	ID         string    `json:"id"`
+	Name       string    `json:"name"`
+	Prefix     string    `json:"prefix"` // First characters of the secret, to tell keys apart
+	Hash       string    `json:"hash,omitempty"`
+	Scopes     []string  `json:"scopes"`
+	RateLimit  int       `json:"rate_limit"`  // Requests per minute, 0 for unlimited
+	DailyQuota int       `json:"daily_quota"` // Demos processed per UTC day, 0 for unlimited
+	CreatedAt  time.Time `json:"created_at"`
+	RevokedAt  time.Time `json:"revoked_at,omitzero"`
+}
+
+// HasScope reports whether the key grants a scope
+func (k *APIKey) HasScope(scope string) bool {
+	return slices.Contains(k.Scopes, scope) || slices.Contains(k.Scopes, ScopeAdmin)
+}
+
+// Revoked reports whether the key has been revoked
+func (k *APIKey) Revoked() bool {
+	return !k.RevokedAt.IsZero()
+}
+
+// ValidateScopes checks that every scope is known
+func ValidateScopes(scopes []string) error {
+	if len(scopes) == 0 {
+		return errors.New("at least one scope is required")
+	}
+	for _, scope := range scopes {
+		if !slices.Contains(Scopes, scope) {
+			return fmt.Errorf("unknown scope %q, must be one of %s", scope, strings.Join(Scopes, ", "))
+		}
+	}
+	return nil
+}
+
+// APIKeyStore persists API keys as JSON files and keeps them in memory for
+// lookups on every request
+type APIKeyStore struct {
+	Dir  string
+	mu   sync.RWMutex
+	keys map[string]*APIKey // By ID
+}
+
+// NewAPIKeyStore loads the keys in dir, creating it if needed
+func NewAPIKeyStore(dir string) (*APIKeyStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &APIKeyStore{Dir: dir, keys: make(map[string]*APIKey)}
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+
+		keyBytes, err := os.ReadFile(filepath.Join(dir, file.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var key APIKey
+		if err := json.Unmarshal(keyBytes, &key); err != nil {
+			return nil, fmt.Errorf("invalid API key file %s: %w", file.Name(), err)
+		}
+		s.keys[key.ID] = &key
+	}
+
+	return s, nil
+}
+
+// Create registers a new key and returns it with its secret, which is not
+// stored and can't be recovered later
+func (s *APIKeyStore) Create(name string, scopes []string, rateLimit, dailyQuota int) (*APIKey, string, error) {
+	if name == "" {
+		return nil, "", errors.New("name is required")
+	}
+	if err := ValidateScopes(scopes); err != nil {
+		return nil, "", err
+	}
+	if rateLimit < 0 || dailyQuota < 0 {
+		return nil, "", errors.New("limits can't be negative")
+	}
+
+	idBytes := make([]byte, 8)
+	secretBytes := make([]byte, 24)
+	rand.Read(idBytes)
+	rand.Read(secretBytes)
+	secret := "dv_" + hex.EncodeToString(secretBytes)
+
+	key := &APIKey{
+		ID:         "key_" + hex.EncodeToString(idBytes),
+		Name:       name,
+		Prefix:     secret[:10],
+		Hash:       hashAPIKey(secret),
+		Scopes:     scopes,
+		RateLimit:  rateLimit,
+		DailyQuota: dailyQuota,
+		CreatedAt:  time.Now(),
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.save(key); err != nil {
+		return nil, "", err
+	}
+	s.keys[key.ID] = key
+
+	return key, secret, nil
+}
+
+// Lookup returns the active key with the given secret
+func (s *APIKeyStore) Lookup(secret string) (*APIKey, error) {
+	hash := hashAPIKey(secret)
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, key := range s.keys {
+		if key.Hash == hash && !key.Revoked() {
+			copied := *key
+			return &copied, nil
+		}
+	}
+	return nil, ErrAPIKeyNotFound
+}
+
+// Get returns a key by ID, including revoked keys
+func (s *APIKeyStore) Get(id string) (*APIKey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	key, ok := s.keys[id]
+	if !ok {
+		return nil, ErrAPIKeyNotFound
+	}
+	copied := *key
+	return &copied, nil
+}
+
+// List returns every key, oldest first
+func (s *APIKeyStore) List() []APIKey {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	keys := make([]APIKey, 0, len(s.keys))
+	for _, key := range s.keys {
+		keys = append(keys, *key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].CreatedAt.Before(keys[j].CreatedAt)
+	})
+	return keys
+}
+
+// Len returns the number of active keys
+func (s *APIKeyStore) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	n := 0
+	for _, key := range s.keys {
+		if !key.Revoked() {
+			n++
+		}
+	}
+	return n
+}
+
+// Revoke disables a key. It is kept so its usage can still be inspected.
+func (s *APIKeyStore) Revoke(id string) (*APIKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key, ok := s.keys[id]
+	if !ok {
+		return nil, ErrAPIKeyNotFound
+	}
+	if !key.Revoked() {
+		revoked := *key
+		revoked.RevokedAt = time.Now()
+		if err := s.save(&revoked); err != nil {
+			return nil, err
+		}
+		s.keys[id] = &revoked
+		key = &revoked
+	}
+
+	copied := *key
+	return &copied, nil
+}
+
+func (s *APIKeyStore) save(key *APIKey) error {
+	keyBytes, err := json.Marshal(key)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(s.Dir, key.ID+".json"), keyBytes, 0600)
+}
+
+func hashAPIKey(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// UsageCounter keeps expiring counters for rate limits, quotas and usage
+// statistics. RedisCache implements it so counters are shared between
+// instances; MemoryCounter is used without Redis.
+type UsageCounter interface {
+	// IncrCounter adds n to a counter and returns the new value. A ttl of 0
+	// keeps the counter forever.
+	IncrCounter(key string, n int64, ttl time.Duration) (int64, error)
+	// GetCounter returns a counter's value, 0 if it does not exist
+	GetCounter(key string) (int64, error)
+}
+
+// MemoryCounter is an in-process UsageCounter; counters are lost on restart
+type MemoryCounter struct {
+	mu       sync.Mutex
+	counters map[string]memoryCount
+}
+
+type memoryCount struct {
+	value   int64
+	expires time.Time
+}
+
+// NewMemoryCounter creates an empty in-process counter
+func NewMemoryCounter() *MemoryCounter {
+	return &MemoryCounter{counters: make(map[string]memoryCount)}
+}
+
+func (c *MemoryCounter) IncrCounter(key string, n int64, ttl time.Duration) (int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	count, ok := c.counters[key]
+	if !ok || (!count.expires.IsZero() && now.After(count.expires)) {
+		count = memoryCount{}
+		if ttl > 0 {
+			count.expires = now.Add(ttl)
+		}
+		// Drop expired counters now and then so the map doesn't grow forever
+		if len(c.counters)%1024 == 0 {
+			for k, v := range c.counters {
+				if !v.expires.IsZero() && now.After(v.expires) {
+					delete(c.counters, k)
+				}
+			}
+		}
+	}
+
+	count.value += n
+	c.counters[key] = count
+	return count.value, nil
+}
+
+func (c *MemoryCounter) GetCounter(key string) (int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	count, ok := c.counters[key]
+	if !ok || (!count.expires.IsZero() && time.Now().After(count.expires)) {
+		return 0, nil
+	}
+	return count.value, nil
+}
@@ -0,0 +1,122 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// AudioExtensions lists the extensions of audio files written by the processor
+var AudioExtensions = []string{".wav", ".ogg"}
+
+// IsAudioFile reports whether a filename has one of the audio extensions
+func IsAudioFile(name string) bool {
+	ext := filepath.Ext(name)
+	for _, audioExt := range AudioExtensions {
+		if ext == audioExt {
+			return true
+		}
+	}
+	return false
+}
+
+// getAudioDuration returns the duration of a WAV or Ogg Opus file as a
+// formatted string
+func getAudioDuration(filePath string) string {
+	if strings.HasSuffix(filePath, ".ogg") {
+		return getOggOpusDuration(filePath)
+	}
+	return getWavDuration(filePath)
+}
+
+// getWavDuration reads a WAV file and returns the duration as a formatted string
+func getWavDuration(filePath string) string {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "?"
+	}
+	defer file.Close()
+
+	// Read WAV header (44 bytes minimum)
+	header := make([]byte, 44)
+	n, err := file.Read(header)
+	if err != nil || n < 44 {
+		return "?"
+	}
+
+	// Verify RIFF header
+	if string(header[0:4]) != "RIFF" || string(header[8:12]) != "WAVE" {
+		return "?"
+	}
+
+	// Extract audio format parameters (little endian)
+	// Bytes 22-23: channels, 24-27: sample rate, 34-35: bits per sample
+	channels := int64(binary.LittleEndian.Uint16(header[22:24]))
+	sampleRate := binary.LittleEndian.Uint32(header[24:28])
+	bitsPerSample := int64(binary.LittleEndian.Uint16(header[34:36]))
+	if sampleRate == 0 || channels == 0 || bitsPerSample == 0 {
+		return "?"
+	}
+
+	// Get file size to calculate duration
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return "?"
+	}
+
+	// WAV data size = file size - header size (44 bytes)
+	// Duration = data size / (sample rate * channels * bytes per sample)
+	dataSize := fileInfo.Size() - 44
+	totalSamples := dataSize / (bitsPerSample / 8 * channels)
+	durationSeconds := float64(totalSamples) / float64(sampleRate)
+
+	return FormatAudioLength(durationSeconds)
+}
+
+// getOggOpusDuration reads the granule position of the last Ogg page, which
+// counts 48 kHz samples including the encoder pre-skip from the OpusHead
+func getOggOpusDuration(filePath string) string {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "?"
+	}
+	defer file.Close()
+
+	// The OpusHead packet is the only packet of the first page
+	head := make([]byte, 64)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return "?"
+	}
+	head = head[:n]
+	index := bytes.Index(head, []byte("OpusHead"))
+	if !bytes.HasPrefix(head, []byte("OggS")) || index < 0 || len(head) < index+12 {
+		return "?"
+	}
+	preSkip := int64(binary.LittleEndian.Uint16(head[index+10 : index+12]))
+
+	// Pages are at most ~64 KB, so the last one starts within the file's tail
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return "?"
+	}
+	tailSize := min(fileInfo.Size(), 65536)
+	tail := make([]byte, tailSize)
+	if _, err := file.ReadAt(tail, fileInfo.Size()-tailSize); err != nil {
+		return "?"
+	}
+
+	last := bytes.LastIndex(tail, []byte("OggS"))
+	if last < 0 || len(tail) < last+14 {
+		return "?"
+	}
+	granule := int64(binary.LittleEndian.Uint64(tail[last+6 : last+14]))
+	if granule < preSkip {
+		return "?"
+	}
+
+	return FormatAudioLength(float64(granule-preSkip) / 48000)
+}
@@ -0,0 +1,56 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// ChatMessage is a single chat message sent during the demo
+type ChatMessage struct {
+	Tick    int     `json:"tick"`
+	Time    float64 `json:"time"` // Seconds since the start of the demo
+	Round   int     `json:"round"`
+	SteamID string  `json:"steam_id,omitempty"` // Empty for console messages
+	Name    string  `json:"name"`
+	Team    string  `json:"team,omitempty"` // "T", "CT" or "Spectator"
+	Alive   bool    `json:"alive"`
+	AllChat bool    `json:"all_chat"`
+	Text    string  `json:"text"`
+}
+
+// ChatLogJSONFilename returns the filename of the structured chat log for a demo
+func ChatLogJSONFilename(demoID string) string {
+	return demoID + "_chat.json"
+}
+
+// SaveChatMessages writes the structured chat log next to the audio files
+// named after outputID
+func (s *MetadataStore) SaveChatMessages(outputID string, messages []ChatMessage) error {
+	chatBytes, err := json.Marshal(messages)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(filepath.Join(s.OutputDir, ChatLogJSONFilename(outputID)), chatBytes, 0644)
+}
+
+// LoadChatMessages loads the structured chat log of the outputs named after outputID
+func (s *MetadataStore) LoadChatMessages(outputID string) ([]ChatMessage, error) {
+	if outputID == "" {
+		return nil, fmt.Errorf("empty demo ID")
+	}
+
+	chatBytes, err := os.ReadFile(filepath.Join(s.OutputDir, ChatLogJSONFilename(outputID)))
+	if err != nil {
+		return nil, err
+	}
+
+	var messages []ChatMessage
+	if err := json.Unmarshal(chatBytes, &messages); err != nil {
+		return nil, err
+	}
+
+	return messages, nil
+}
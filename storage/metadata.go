@@ -2,12 +2,12 @@ package storage
 
 import (
 	"demovoice/api"
-	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"log"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 	"time"
 )
@@ -23,7 +23,7 @@ type MetadataStore struct {
 type DemoMetadata struct {
 	DemoID        string           `json:"demo_id"`
 	Filename      string           `json:"filename"`
-	Status        string           `json:"status"` // "processing", "completed", "failed"
+	Status        string           `json:"status"` // "downloading", "queued", "processing", "enriching", "completed", "failed"
 	Players       []api.PlayerInfo `json:"players"`
 	UploadTime    time.Time        `json:"upload_time"`
 	MatchID       string           `json:"match_id,omitempty"`
@@ -31,6 +31,80 @@ type DemoMetadata struct {
 	Competition   string           `json:"competition,omitempty"`
 	MatchDataJSON string           `json:"match_data_json,omitempty"` // Cached match data for faster loading
 	ChatLog       string           `json:"chat_log,omitempty"`        // Filename of the chat log
+	ChatLogJSON   string           `json:"chat_log_json,omitempty"`   // Filename of the structured chat log
+	Segments      string           `json:"segments,omitempty"`        // Filename of the voice segment index
+	Mixdown       string           `json:"mixdown,omitempty"`         // Filename of the full-match mixed track
+	Rounds        []RoundInfo      `json:"rounds,omitempty"`          // Per-round clips when split by round
+	SubtitlesVTT  string           `json:"subtitles_vtt,omitempty"`   // Filename of the WebVTT "who is speaking" track
+	SubtitlesSRT  string           `json:"subtitles_srt,omitempty"`   // Filename of the SRT "who is speaking" track
+	Error         *ProcessingError `json:"error,omitempty"`           // Why processing failed
+	Version       int              `json:"version,omitempty"`         // Incremented each time the demo is processed
+	OutputID      string           `json:"output_id,omitempty"`       // Filename prefix of the latest run's outputs when it is not the demo ID
+	Runs          []ProcessingRun  `json:"runs,omitempty"`            // Processing history, oldest first
+	Source        string           `json:"source,omitempty"`          // Retained source demo, while it can be reprocessed
+	ContentHash   string           `json:"content_hash,omitempty"`    // "sha256:<hex>" of the decompressed demo
+	Options       RunOptions       `json:"options,omitzero"`          // Normalized options of the latest run, part of the dedup key
+	Warnings      []string         `json:"warnings,omitempty"`        // Problems processing worked around
+}
+
+// ProcessingRun records one extraction of a demo. Each run writes its outputs
+// under its own filenames, so earlier runs' files stay available until they
+// expire.
+type ProcessingRun struct {
+	Version    int              `json:"version"`
+	Options    RunOptions       `json:"options"`
+	Status     string           `json:"status"`
+	Error      *ProcessingError `json:"error,omitempty"`
+	Files      []string         `json:"files,omitempty"` // Output files of the run
+	StartedAt  time.Time        `json:"started_at"`
+	FinishedAt time.Time        `json:"finished_at,omitzero"`
+}
+
+// RunOutputID returns the filename prefix of a run's outputs: the demo ID for
+// the first run and <demoID>_v<version> for reprocessing runs
+func RunOutputID(demoID string, version int) string {
+	if version <= 1 {
+		return demoID
+	}
+	return fmt.Sprintf("%s_v%d", demoID, version)
+}
+
+// RunOptions are the extraction options a run was made with
+type RunOptions struct {
+	ChatOnly    bool   `json:"chat_only"`
+	TickAligned bool   `json:"tick_aligned"`
+	Mixdown     bool   `json:"mixdown"`
+	SplitRounds bool   `json:"split_rounds"`
+	Format      string `json:"format"`
+}
+
+// Key returns the options as a string for index keys
+func (o RunOptions) Key() string {
+	return fmt.Sprintf("%s:%t:%t:%t:%t", o.Format, o.ChatOnly, o.TickAligned, o.Mixdown, o.SplitRounds)
+}
+
+// ProcessingError describes why a demo failed with a machine-readable code
+// and a human-readable message
+type ProcessingError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// sidecarSuffixes are the per-demo JSON files stored next to the metadata
+var sidecarSuffixes = []string{"_segments.json", "_chat.json"}
+
+// isMetadataFile reports whether a file in the output directory holds demo
+// metadata rather than a player file or a per-demo sidecar
+func isMetadataFile(name string) bool {
+	if !strings.HasSuffix(name, ".json") || strings.HasPrefix(name, "player_") {
+		return false
+	}
+	for _, suffix := range sidecarSuffixes {
+		if strings.HasSuffix(name, suffix) {
+			return false
+		}
+	}
+	return true
 }
 
 // NewMetadataStore creates a new metadata store backed only by the filesystem.
@@ -45,71 +119,107 @@ func NewMetadataStoreWithRedis(outputDir string, cache *RedisCache, ttl time.Dur
 	return &MetadataStore{OutputDir: outputDir, redis: cache, redisTTL: ttl}
 }
 
-// SaveMetadata saves metadata about a processed demo
-func (s *MetadataStore) SaveMetadata(demoID, filename string) (*DemoMetadata, error) {
+// SaveMetadata saves metadata about a processed demo whose outputs are named
+// after outputID (see RunOutputID)
+func (s *MetadataStore) SaveMetadata(demoID, outputID, filename string) (*DemoMetadata, error) {
+	// Extract match ID from filename if possible
+	// Format: 1-51dcaf59-f8aa-4df1-b20e-168f4b590c52-1-1.dem
+	metadata := DemoMetadata{
+		DemoID:     demoID,
+		Filename:   filename,
+		UploadTime: time.Now(),
+		MatchID:    ExtractMatchIDFromFilename(filename),
+		Status:     "completed",
+	}
+	if err := s.ScanOutputs(&metadata, outputID); err != nil {
+		return nil, err
+	}
+
+	metadataBytes, err := json.Marshal(metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	metadataPath := filepath.Join(s.OutputDir, demoID+".json")
+	if err := os.WriteFile(metadataPath, metadataBytes, 0644); err != nil {
+		return nil, err
+	}
+
+	return &metadata, nil
+}
+
+// ScanOutputs records the output files of a run named after outputID in
+// metadata, replacing those of earlier runs. Subtitles are cleared; they are
+// written from the recorded outputs afterwards. The metadata is not saved.
+func (s *MetadataStore) ScanOutputs(metadata *DemoMetadata, outputID string) error {
 	// Read the output directory to find files associated with this demo
 	files, err := os.ReadDir(s.OutputDir)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	var players []api.PlayerInfo
 	for _, file := range files {
-		if !file.IsDir() && strings.Contains(file.Name(), "_"+demoID+".wav") {
-			// Extract steamID from filename (format: steamID_demoID.wav)
-			parts := strings.Split(file.Name(), "_"+demoID+".wav")
-			if len(parts) > 0 {
-				steamID := parts[0]
-
+		if file.IsDir() {
+			continue
+		}
+		for _, ext := range AudioExtensions {
+			// Extract steamID from filename (format: steamID_outputID.wav or .ogg)
+			steamID, found := strings.CutSuffix(file.Name(), "_"+outputID+ext)
+			if found {
 				// Calculate audio duration
-				audioLength := getWavDuration(filepath.Join(s.OutputDir, file.Name()))
+				audioLength := getAudioDuration(filepath.Join(s.OutputDir, file.Name()))
 
 				players = append(players, api.PlayerInfo{
 					SteamID:     steamID,
 					AudioFile:   file.Name(),
 					AudioLength: audioLength,
-					DemoID:      demoID,
+					DemoID:      metadata.DemoID,
 				})
 			}
 		}
 	}
 
 	// Log for debugging
-	log.Printf("Found %d player voices for demo ID %s", len(players), demoID)
+	log.Printf("Found %d player voices for demo ID %s", len(players), metadata.DemoID)
 
 	// Check for chat logs
 	var chatLog string
-	chatLogPath := demoID + "_chat.txt"
+	chatLogPath := outputID + "_chat.txt"
 	if _, err := os.Stat(filepath.Join(s.OutputDir, chatLogPath)); err == nil {
 		chatLog = chatLogPath
 	}
-
-	// Extract match ID from filename if possible
-	// Format: 1-51dcaf59-f8aa-4df1-b20e-168f4b590c52-1-1.dem
-	matchID := ExtractMatchIDFromFilename(filename)
-
-	// Save metadata as JSON
-	metadata := DemoMetadata{
-		DemoID:     demoID,
-		Filename:   filename,
-		Players:    players,
-		UploadTime: time.Now(),
-		MatchID:    matchID,
-		Status:     "completed",
-		ChatLog:    chatLog,
+	var chatLogJSON string
+	if _, err := os.Stat(filepath.Join(s.OutputDir, ChatLogJSONFilename(outputID))); err == nil {
+		chatLogJSON = ChatLogJSONFilename(outputID)
 	}
 
-	metadataBytes, err := json.Marshal(metadata)
-	if err != nil {
-		return nil, err
+	// Check for the voice segment index
+	var segments string
+	if _, err := os.Stat(filepath.Join(s.OutputDir, SegmentIndexFilename(outputID))); err == nil {
+		segments = SegmentIndexFilename(outputID)
 	}
 
-	metadataPath := filepath.Join(s.OutputDir, demoID+".json")
-	if err := os.WriteFile(metadataPath, metadataBytes, 0644); err != nil {
-		return nil, err
+	// Check for the full-match mixdown
+	var mixdown string
+	for _, ext := range AudioExtensions {
+		if _, err := os.Stat(filepath.Join(s.OutputDir, MixdownFilename(outputID, ext))); err == nil {
+			mixdown = MixdownFilename(outputID, ext)
+		}
 	}
 
-	return &metadata, nil
+	metadata.Players = players
+	metadata.ChatLog = chatLog
+	metadata.ChatLogJSON = chatLogJSON
+	metadata.Segments = segments
+	metadata.Mixdown = mixdown
+	metadata.SubtitlesVTT = ""
+	metadata.SubtitlesSRT = ""
+	metadata.OutputID = ""
+	if outputID != metadata.DemoID {
+		metadata.OutputID = outputID
+	}
+	return nil
 }
 
 // LoadMetadata loads metadata for a specific demo ID.
@@ -153,7 +263,7 @@ func (s *MetadataStore) ListAllDemos() ([]DemoMetadata, error) {
 
 	var demos []DemoMetadata
 	for _, file := range files {
-		if !file.IsDir() && strings.HasSuffix(file.Name(), ".json") && !strings.HasPrefix(file.Name(), "player_") {
+		if !file.IsDir() && isMetadataFile(file.Name()) {
 			demoID := strings.TrimSuffix(file.Name(), ".json")
 			metadata, err := s.LoadMetadata(demoID)
 			if err == nil {
@@ -216,35 +326,76 @@ func (s *MetadataStore) UpdateMetadata(metadata *DemoMetadata) error {
 		return err
 	}
 
-	if s.redis != nil {
-		_ = s.redis.SetMetadata(metadata, s.redisTTL)
-		if metadata.MatchID != "" {
-			_ = s.redis.SetMatchIndex(metadata.MatchID, metadata.DemoID, s.redisTTL)
-		}
+	s.cacheMetadata(metadata)
+	return nil
+}
+
+// cacheMetadata stores metadata and its match and content indexes in Redis
+func (s *MetadataStore) cacheMetadata(metadata *DemoMetadata) {
+	if s.redis == nil {
+		return
 	}
 
-	return nil
+	_ = s.redis.SetMetadata(metadata, s.redisTTL)
+	if metadata.MatchID != "" {
+		_ = s.redis.SetMatchIndex(metadata.MatchID+":"+metadata.Options.Key(), metadata.DemoID, s.redisTTL)
+	}
+	if metadata.ContentHash != "" {
+		_ = s.redis.SetHashIndex(metadata.ContentHash+":"+metadata.Options.Key(), metadata.DemoID, s.redisTTL)
+	}
 }
 
-// FindDemoByMatchID finds an existing demo for a specific match ID.
+// FindDemoByMatchID finds an existing demo for a specific match ID that was
+// processed with the same (normalized) options.
 // Checks Redis first (O(1)); falls back to a directory scan when Redis is
 // unavailable. Returns nil without error when no valid demo is found.
-func (s *MetadataStore) FindDemoByMatchID(matchID string, maxAge time.Duration) (*DemoMetadata, error) {
+func (s *MetadataStore) FindDemoByMatchID(matchID string, opts RunOptions, maxAge time.Duration) (*DemoMetadata, error) {
 	if matchID == "" {
 		return nil, nil
 	}
 
-	// Fast path: Redis index lookup.
+	var index func() (string, error)
+	if s.redis != nil {
+		index = func() (string, error) { return s.redis.GetMatchIndex(matchID + ":" + opts.Key()) }
+	}
+	return s.findDemo("match "+matchID, index, maxAge, func(metadata *DemoMetadata) bool {
+		return metadata.MatchID == matchID && metadata.Options == opts
+	})
+}
+
+// FindDemoByContentHash finds an existing demo with the same content that
+// was processed with the same (normalized) options, so identical demos are
+// only processed once whatever their filename. Demos still queued or
+// processing are returned too. Returns nil without error when no valid demo
+// is found.
+func (s *MetadataStore) FindDemoByContentHash(hash string, opts RunOptions, maxAge time.Duration) (*DemoMetadata, error) {
+	if hash == "" {
+		return nil, nil
+	}
+
+	var index func() (string, error)
 	if s.redis != nil {
-		if demoID, err := s.redis.GetMatchIndex(matchID); err == nil {
+		index = func() (string, error) { return s.redis.GetHashIndex(hash + ":" + opts.Key()) }
+	}
+	return s.findDemo("content "+hash, index, maxAge, func(metadata *DemoMetadata) bool {
+		return metadata.ContentHash == hash && metadata.Options == opts
+	})
+}
+
+// findDemo looks a demo up in a Redis index, then by scanning the output
+// directory for metadata that matches. Failed and expired demos are skipped.
+func (s *MetadataStore) findDemo(what string, index func() (string, error), maxAge time.Duration, matches func(*DemoMetadata) bool) (*DemoMetadata, error) {
+	// Fast path: Redis index lookup.
+	if index != nil {
+		if demoID, err := index(); err == nil {
 			metadata, err := s.LoadMetadata(demoID)
-			if err == nil && metadata.Status != "failed" {
+			if err == nil && metadata.Status != "failed" && matches(metadata) {
 				age := time.Since(metadata.UploadTime)
 				if age <= maxAge {
-					log.Printf("Redis cache HIT for match %s → demo %s (age: %v)", matchID, demoID, age)
+					log.Printf("Redis cache HIT for %s → demo %s (age: %v)", what, demoID, age)
 					return metadata, nil
 				}
-				log.Printf("Redis cache HIT but expired for match %s (age: %v, max: %v)", matchID, age, maxAge)
+				log.Printf("Redis cache HIT but expired for %s (age: %v, max: %v)", what, age, maxAge)
 				s.redis.DeleteMetadata(demoID)
 			} else if err == nil && metadata.Status == "failed" {
 				log.Printf("Redis cache HIT but demo %s failed — evicting and retrying", demoID)
@@ -261,25 +412,22 @@ func (s *MetadataStore) FindDemoByMatchID(matchID string, maxAge time.Duration)
 
 	now := time.Now()
 	for _, file := range files {
-		if !file.IsDir() && strings.HasSuffix(file.Name(), ".json") && !strings.HasPrefix(file.Name(), "player_") {
+		if !file.IsDir() && isMetadataFile(file.Name()) {
 			demoID := strings.TrimSuffix(file.Name(), ".json")
 			metadata, err := s.LoadMetadata(demoID)
 			if err != nil {
 				continue
 			}
 
-			if metadata.MatchID == matchID && metadata.Status != "failed" {
+			if matches(metadata) && metadata.Status != "failed" {
 				age := now.Sub(metadata.UploadTime)
 				if age <= maxAge {
-					log.Printf("Found existing demo for match %s: %s (age: %v)", matchID, demoID, age)
-					// Populate the Redis index so future lookups are fast.
-					if s.redis != nil {
-						_ = s.redis.SetMatchIndex(matchID, demoID, s.redisTTL)
-						_ = s.redis.SetMetadata(metadata, s.redisTTL)
-					}
+					log.Printf("Found existing demo for %s: %s (age: %v)", what, demoID, age)
+					// Populate the Redis cache so future lookups are fast.
+					s.cacheMetadata(metadata)
 					return metadata, nil
 				}
-				log.Printf("Found expired demo for match %s: %s (age: %v, max: %v)", matchID, demoID, age, maxAge)
+				log.Printf("Found expired demo for %s: %s (age: %v, max: %v)", what, demoID, age, maxAge)
 			}
 		}
 	}
@@ -287,6 +435,73 @@ func (s *MetadataStore) FindDemoByMatchID(matchID string, maxAge time.Duration)
 	return nil, nil
 }
 
+// OutputPrefix returns the filename prefix of the demo's current outputs
+func (m *DemoMetadata) OutputPrefix() string {
+	if m.OutputID != "" {
+		return m.OutputID
+	}
+	return m.DemoID
+}
+
+// OutputFiles returns the names of every file generated by the demo's latest
+// run in the output directory, not including the metadata itself
+func (m *DemoMetadata) OutputFiles() []string {
+	var files []string
+	for _, player := range m.Players {
+		if player.AudioFile != "" {
+			files = append(files, player.AudioFile)
+		}
+	}
+	for _, filename := range []string{m.ChatLog, m.ChatLogJSON, m.Segments, m.Mixdown, m.SubtitlesVTT, m.SubtitlesSRT} {
+		if filename != "" {
+			files = append(files, filename)
+		}
+	}
+	for _, round := range m.Rounds {
+		for _, clip := range round.Clips {
+			files = append(files, clip.AudioFile)
+		}
+		if round.Mixdown != "" {
+			files = append(files, round.Mixdown)
+		}
+	}
+	return files
+}
+
+// AllOutputFiles returns the output files of the latest run followed by
+// those of earlier runs that may still exist
+func (m *DemoMetadata) AllOutputFiles() []string {
+	files := m.OutputFiles()
+	for _, run := range m.Runs {
+		for _, filename := range run.Files {
+			if !slices.Contains(files, filename) {
+				files = append(files, filename)
+			}
+		}
+	}
+	return files
+}
+
+// DeleteDemo removes the output files of every run of a demo and its metadata
+// from disk and Redis
+func (s *MetadataStore) DeleteDemo(metadata *DemoMetadata) error {
+	for _, filename := range metadata.AllOutputFiles() {
+		if err := os.Remove(filepath.Join(s.OutputDir, filename)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	if s.redis != nil {
+		s.redis.DeleteMetadata(metadata.DemoID)
+	}
+
+	metadataPath := filepath.Join(s.OutputDir, metadata.DemoID+".json")
+	if err := os.Remove(metadataPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
 // ExtractMatchIDFromFilename extracts the Faceit match ID from a demo filename
 // Format: 1-51dcaf59-f8aa-4df1-b20e-168f4b590c52-1-1.dem or 1-51dcaf59-f8aa-4df1-b20e-168f4b590c52.dem.zst
 // Returns: 1-51dcaf59-f8aa-4df1-b20e-168f4b590c52
@@ -308,50 +523,19 @@ func ExtractMatchIDFromFilename(filename string) string {
 	return ""
 }
 
-// getWavDuration reads a WAV file and returns the duration as a formatted string
-func getWavDuration(filePath string) string {
-	file, err := os.Open(filePath)
-	if err != nil {
-		return "?"
-	}
-	defer file.Close()
-
-	// Read WAV header (44 bytes minimum)
-	header := make([]byte, 44)
-	n, err := file.Read(header)
-	if err != nil || n < 44 {
-		return "?"
-	}
-
-	// Verify RIFF header
-	if string(header[0:4]) != "RIFF" || string(header[8:12]) != "WAVE" {
-		return "?"
-	}
-
-	// Extract audio format parameters
-	// Bytes 24-27: Sample Rate (little endian)
-	sampleRate := binary.LittleEndian.Uint32(header[24:28])
-	if sampleRate == 0 {
-		return "?"
-	}
-
-	// Get file size to calculate duration
-	fileInfo, err := file.Stat()
-	if err != nil {
-		return "?"
-	}
-
-	// WAV data size = file size - header size (44 bytes)
-	// Duration = data size / (sample rate * channels * bytes per sample)
-	// For our files: 1 channel, 32 bits (4 bytes) per sample
-	dataSize := fileInfo.Size() - 44
-	bytesPerSample := 4 // 32-bit samples
-	channels := 1
+// MixdownFilename returns the filename of the full-match mixed track for a demo.
+// It deliberately does not end in "_<demoID><ext>" so it is not mistaken for a player.
+func MixdownFilename(demoID, ext string) string {
+	return demoID + "_mix" + ext
+}
 
-	totalSamples := dataSize / int64(bytesPerSample*channels)
-	durationSeconds := float64(totalSamples) / float64(sampleRate)
+// RoundMixdownFilename returns the filename of a single round's mixed track
+func RoundMixdownFilename(demoID string, round int, ext string) string {
+	return fmt.Sprintf("%s_mix_r%d%s", demoID, round, ext)
+}
 
-	// Format duration as "1m 23s" or "45s"
+// FormatAudioLength formats a duration in seconds as "1m 23s" or "45s"
+func FormatAudioLength(durationSeconds float64) string {
 	minutes := int(durationSeconds) / 60
 	seconds := int(durationSeconds) % 60
 
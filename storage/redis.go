@@ -53,14 +53,28 @@ func (r *RedisCache) GetMetadata(demoID string) (*DemoMetadata, error) {
 	return &metadata, nil
 }
 
-// SetMatchIndex stores a matchID → demoID mapping with a TTL.
+// SetMatchIndex stores a matchID and options key → demoID mapping with a TTL.
 func (r *RedisCache) SetMatchIndex(matchID, demoID string, ttl time.Duration) error {
 	return r.client.Set(r.ctx, "demo:match:"+matchID, demoID, ttl).Err()
 }
 
-// GetMatchIndex returns the demoID for a given matchID.
+// GetMatchIndex returns the demoID for a given matchID and options key.
 func (r *RedisCache) GetMatchIndex(matchID string) (string, error) {
-	demoID, err := r.client.Get(r.ctx, "demo:match:"+matchID).Result()
+	return r.getIndex("demo:match:" + matchID)
+}
+
+// SetHashIndex stores a content hash and options key → demoID mapping with a TTL.
+func (r *RedisCache) SetHashIndex(hash, demoID string, ttl time.Duration) error {
+	return r.client.Set(r.ctx, "demo:hash:"+hash, demoID, ttl).Err()
+}
+
+// GetHashIndex returns the demoID for a given content hash and options key.
+func (r *RedisCache) GetHashIndex(hash string) (string, error) {
+	return r.getIndex("demo:hash:" + hash)
+}
+
+func (r *RedisCache) getIndex(key string) (string, error) {
+	demoID, err := r.client.Get(r.ctx, key).Result()
 	if errors.Is(err, redis.Nil) {
 		return "", ErrCacheMiss
 	}
@@ -70,3 +84,24 @@ func (r *RedisCache) GetMatchIndex(matchID string) (string, error) {
 func (r *RedisCache) DeleteMetadata(demoID string) {
 	r.client.Del(r.ctx, "demo:metadata:"+demoID)
 }
+
+// IncrCounter adds n to a usage counter, setting its TTL when it is created.
+func (r *RedisCache) IncrCounter(key string, n int64, ttl time.Duration) (int64, error) {
+	value, err := r.client.IncrBy(r.ctx, "demo:counter:"+key, n).Result()
+	if err != nil {
+		return 0, err
+	}
+	if ttl > 0 && value == n {
+		r.client.Expire(r.ctx, "demo:counter:"+key, ttl)
+	}
+	return value, nil
+}
+
+// GetCounter returns a usage counter, 0 if it does not exist.
+func (r *RedisCache) GetCounter(key string) (int64, error) {
+	value, err := r.client.Get(r.ctx, "demo:counter:"+key).Int64()
+	if errors.Is(err, redis.Nil) {
+		return 0, nil
+	}
+	return value, err
+}
@@ -0,0 +1,22 @@
+package storage
+
+// RoundInfo describes one round of a demo and the voice clips recorded in it
+type RoundInfo struct {
+	Number    int         `json:"number"`
+	StartTick int         `json:"start_tick"`
+	EndTick   int         `json:"end_tick"`
+	StartTime float64     `json:"start_time"` // Seconds since the start of the demo
+	EndTime   float64     `json:"end_time"`
+	Winner    string      `json:"winner,omitempty"` // "T" or "CT"
+	ScoreT    int         `json:"score_t"`          // Score of the round's Terrorists after the round
+	ScoreCT   int         `json:"score_ct"`         // Score of the round's Counter-Terrorists after the round
+	Clips     []RoundClip `json:"clips,omitempty"`
+	Mixdown   string      `json:"mixdown,omitempty"` // Filename of the round's mixed track
+}
+
+// RoundClip is a single player's voice during one round
+type RoundClip struct {
+	SteamID     string `json:"steam_id"`
+	AudioFile   string `json:"audio_file"`
+	AudioLength string `json:"audio_length"`
+}
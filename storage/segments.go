@@ -0,0 +1,74 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// VoiceSegment is a single continuous utterance in a player's voice track.
+// Ticks and times are demo positions; samples and bytes are offsets into the
+// player's audio file.
+type VoiceSegment struct {
+	StartTick   int     `json:"start_tick"`
+	EndTick     int     `json:"end_tick"`
+	StartTime   float64 `json:"start_time"` // Seconds since the start of the demo
+	EndTime     float64 `json:"end_time"`
+	Round       int     `json:"round"`
+	StartSample int     `json:"start_sample"`
+	EndSample   int     `json:"end_sample"`
+	StartByte   int64   `json:"start_byte,omitempty"` // Not set for compressed (Ogg) tracks
+	EndByte     int64   `json:"end_byte,omitempty"`
+}
+
+// PlayerVoiceIndex lists the speech segments of one player's voice track
+type PlayerVoiceIndex struct {
+	SteamID    string         `json:"steam_id"`
+	Name       string         `json:"name,omitempty"` // In-demo player name
+	AudioFile  string         `json:"audio_file"`
+	SampleRate int            `json:"sample_rate"`
+	Segments   []VoiceSegment `json:"segments"`
+}
+
+// VoiceIndex is the segment index for every player in a demo
+type VoiceIndex struct {
+	DemoID  string             `json:"demo_id"`
+	Players []PlayerVoiceIndex `json:"players"`
+}
+
+// SegmentIndexFilename returns the filename of the segment index for a demo
+func SegmentIndexFilename(demoID string) string {
+	return demoID + "_segments.json"
+}
+
+// SaveVoiceIndex writes the segment index next to the audio files named
+// after outputID
+func (s *MetadataStore) SaveVoiceIndex(outputID string, index *VoiceIndex) error {
+	indexBytes, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+
+	indexPath := filepath.Join(s.OutputDir, SegmentIndexFilename(outputID))
+	return os.WriteFile(indexPath, indexBytes, 0644)
+}
+
+// LoadVoiceIndex loads the segment index of the outputs named after outputID
+func (s *MetadataStore) LoadVoiceIndex(outputID string) (*VoiceIndex, error) {
+	if outputID == "" {
+		return nil, fmt.Errorf("empty demo ID")
+	}
+
+	indexBytes, err := os.ReadFile(filepath.Join(s.OutputDir, SegmentIndexFilename(outputID)))
+	if err != nil {
+		return nil, err
+	}
+
+	var index VoiceIndex
+	if err := json.Unmarshal(indexBytes, &index); err != nil {
+		return nil, err
+	}
+
+	return &index, nil
+}
@@ -0,0 +1,142 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// chatCueDuration is how long a chat message stays on screen
+const chatCueDuration = 4.0
+
+// subtitleCue is a single timed caption; times are seconds since demo start
+type subtitleCue struct {
+	Start float64
+	End   float64
+	Text  string
+}
+
+// SubtitleFilenames returns the WebVTT and SRT subtitle filenames for a demo
+func SubtitleFilenames(demoID string) (vtt, srt string) {
+	return demoID + ".vtt", demoID + ".srt"
+}
+
+// WriteSubtitles writes WebVTT and SRT tracks that mark every voice segment
+// with the speaking player and show chat messages as cues. Player names come
+// from the (enriched) metadata, falling back to the in-demo name. The
+// filenames are recorded in the metadata; the caller is responsible for
+// saving it.
+func (s *MetadataStore) WriteSubtitles(metadata *DemoMetadata) error {
+	nicknames := make(map[string]string, len(metadata.Players))
+	for _, player := range metadata.Players {
+		if player.Nickname != "" {
+			nicknames[player.SteamID] = player.Nickname
+		}
+	}
+
+	var cues []subtitleCue
+
+	if metadata.Segments != "" {
+		index, err := s.LoadVoiceIndex(metadata.OutputPrefix())
+		if err != nil {
+			return fmt.Errorf("failed to load segment index: %w", err)
+		}
+
+		for _, player := range index.Players {
+			name := nicknames[player.SteamID]
+			if name == "" {
+				name = player.Name
+			}
+			if name == "" {
+				name = player.SteamID
+			}
+
+			for _, segment := range player.Segments {
+				cues = append(cues, subtitleCue{
+					Start: segment.StartTime,
+					End:   segment.EndTime,
+					Text:  "🎙 " + name,
+				})
+			}
+		}
+	}
+
+	if metadata.ChatLogJSON != "" {
+		messages, err := s.LoadChatMessages(metadata.OutputPrefix())
+		if err != nil {
+			return fmt.Errorf("failed to load chat log: %w", err)
+		}
+
+		for _, message := range messages {
+			name := message.Name
+			if nickname := nicknames[message.SteamID]; nickname != "" {
+				name = nickname
+			}
+
+			prefix := "[TEAM]"
+			if message.AllChat {
+				prefix = "[ALL]"
+			}
+
+			cues = append(cues, subtitleCue{
+				Start: message.Time,
+				End:   message.Time + chatCueDuration,
+				Text:  fmt.Sprintf("%s %s: %s", prefix, name, message.Text),
+			})
+		}
+	}
+
+	if len(cues) == 0 {
+		return nil
+	}
+
+	sort.SliceStable(cues, func(i, j int) bool {
+		return cues[i].Start < cues[j].Start
+	})
+
+	vttName, srtName := SubtitleFilenames(metadata.OutputPrefix())
+	if err := os.WriteFile(filepath.Join(s.OutputDir, vttName), []byte(formatWebVTT(cues)), 0644); err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(s.OutputDir, srtName), []byte(formatSRT(cues)), 0644); err != nil {
+		return err
+	}
+
+	metadata.SubtitlesVTT = vttName
+	metadata.SubtitlesSRT = srtName
+	return nil
+}
+
+func formatWebVTT(cues []subtitleCue) string {
+	escaper := strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+	var b strings.Builder
+	b.WriteString("WEBVTT\n\n")
+	for _, cue := range cues {
+		fmt.Fprintf(&b, "%s --> %s\n%s\n\n",
+			formatCueTime(cue.Start, "."), formatCueTime(cue.End, "."), escaper.Replace(cue.Text))
+	}
+	return b.String()
+}
+
+func formatSRT(cues []subtitleCue) string {
+	var b strings.Builder
+	for i, cue := range cues {
+		fmt.Fprintf(&b, "%d\n%s --> %s\n%s\n\n",
+			i+1, formatCueTime(cue.Start, ","), formatCueTime(cue.End, ","), cue.Text)
+	}
+	return b.String()
+}
+
+// formatCueTime formats seconds as HH:MM:SS.mmm (WebVTT) or HH:MM:SS,mmm (SRT)
+func formatCueTime(seconds float64, millisSeparator string) string {
+	millis := int64(seconds*1000 + 0.5)
+	if millis < 0 {
+		millis = 0
+	}
+
+	return fmt.Sprintf("%02d:%02d:%02d%s%03d",
+		millis/3600000, millis/60000%60, millis/1000%60, millisSeparator, millis%1000)
+}
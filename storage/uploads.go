@@ -0,0 +1,233 @@
+package storage
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrUploadOffset is returned when a chunk does not start where the upload ends
+var ErrUploadOffset = errors.New("chunk offset does not match the upload offset")
+
+// ErrUploadBusy is returned when another chunk of the upload is still being written
+var ErrUploadBusy = errors.New("another chunk of this upload is in progress")
+
+// ErrUploadTooLarge is returned when a chunk would grow an upload past its length
+var ErrUploadTooLarge = errors.New("chunk exceeds the upload length")
+
+// ResumableUpload is a demo being uploaded in chunks. The bytes received so
+// far are kept next to it in a .part file whose size is the upload offset.
+type ResumableUpload struct {
+	ID        string      `json:"id"`
+	Filename  string      `json:"filename"`
+	Length    int64       `json:"length"`
+	Checksum  string      `json:"checksum,omitempty"` // Expected "sha256:<hex>" of the whole file
+	Options   RunOptions  `json:"options"`
+	Callback  *UploadHook `json:"callback,omitempty"`
+	KeyID     string      `json:"key_id,omitempty"` // API key that created the upload
+	Status    string      `json:"status"`           // "uploading", "verifying", "completed" or "failed"
+	DemoID    string      `json:"demo_id,omitempty"`
+	Error     string      `json:"error,omitempty"`
+	ErrorCode string      `json:"error_code,omitempty"` // Why verifying failed, e.g. "checksum_mismatch"
+	CreatedAt time.Time   `json:"created_at"`
+	ExpiresAt time.Time   `json:"expires_at"`
+}
+
+// UploadHook is the completion webhook requested for a resumable upload
+type UploadHook struct {
+	URL     string `json:"url"`
+	Secret  string `json:"secret,omitempty"`
+	BaseURL string `json:"base_url"`
+}
+
+// UploadStore keeps resumable uploads and their partial files in a directory
+type UploadStore struct {
+	Dir    string
+	mu     sync.Mutex
+	active map[string]bool // Uploads with a chunk being written
+}
+
+// NewUploadStore creates an upload store in dir, creating it if needed
+func NewUploadStore(dir string) (*UploadStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &UploadStore{Dir: dir, active: make(map[string]bool)}, nil
+}
+
+// Create starts a new upload with an empty partial file
+func (s *UploadStore) Create(upload *ResumableUpload) error {
+	idBytes := make([]byte, 12)
+	rand.Read(idBytes)
+	upload.ID = "up_" + hex.EncodeToString(idBytes)
+	upload.Status = "uploading"
+	upload.CreatedAt = time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := os.WriteFile(s.PartPath(upload.ID), nil, 0600); err != nil {
+		return err
+	}
+	return s.save(upload)
+}
+
+// Load reads an upload by ID
+func (s *UploadStore) Load(id string) (*ResumableUpload, error) {
+	if id == "" || strings.ContainsAny(id, `/\.`) {
+		return nil, fmt.Errorf("invalid upload ID %q", id)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.load(id)
+}
+
+// Save writes an upload's state
+func (s *UploadStore) Save(upload *ResumableUpload) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.save(upload)
+}
+
+// Offset returns how many bytes of an upload have been received
+func (s *UploadStore) Offset(id string) (int64, error) {
+	info, err := os.Stat(s.PartPath(id))
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// WriteChunk appends a chunk that starts at offset and returns the new
+// offset. A chunk cut short by a dropped connection is kept up to where it
+// stopped, so the client can resume from there.
+func (s *UploadStore) WriteChunk(upload *ResumableUpload, offset int64, chunk io.Reader) (int64, error) {
+	// Chunks can take minutes, so only the upload itself is locked
+	s.mu.Lock()
+	if s.active[upload.ID] {
+		s.mu.Unlock()
+		return 0, ErrUploadBusy
+	}
+	s.active[upload.ID] = true
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.active, upload.ID)
+		s.mu.Unlock()
+	}()
+
+	part, err := os.OpenFile(s.PartPath(upload.ID), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return 0, err
+	}
+	defer part.Close()
+
+	info, err := part.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if info.Size() != offset {
+		return info.Size(), ErrUploadOffset
+	}
+
+	// Read one byte more than allowed to detect oversized chunks
+	remaining := upload.Length - offset
+	n, err := io.Copy(part, io.LimitReader(chunk, remaining+1))
+	if n > remaining {
+		part.Truncate(upload.Length)
+		return upload.Length, ErrUploadTooLarge
+	}
+	return offset + n, err
+}
+
+// Finish marks a fully received upload as verifying, so no more chunks are
+// accepted. It returns false when another request already finished it.
+func (s *UploadStore) Finish(id string) (*ResumableUpload, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	upload, err := s.load(id)
+	if err != nil || upload.Status != "uploading" {
+		return nil, false
+	}
+	upload.Status = "verifying"
+	if err := s.save(upload); err != nil {
+		return nil, false
+	}
+	return upload, true
+}
+
+// Remove deletes an upload and its partial file
+func (s *UploadStore) Remove(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	os.Remove(s.PartPath(id))
+	os.Remove(s.statePath(id))
+}
+
+// Expired returns uploads whose expiry time has passed
+func (s *UploadStore) Expired() []ResumableUpload {
+	files, err := os.ReadDir(s.Dir)
+	if err != nil {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var expired []ResumableUpload
+	now := time.Now()
+	for _, file := range files {
+		id, found := strings.CutSuffix(file.Name(), ".json")
+		if file.IsDir() || !found {
+			continue
+		}
+
+		upload, err := s.load(id)
+		if err == nil && now.After(upload.ExpiresAt) {
+			expired = append(expired, *upload)
+		}
+	}
+	return expired
+}
+
+// PartPath returns the path of an upload's partial file
+func (s *UploadStore) PartPath(id string) string {
+	return filepath.Join(s.Dir, id+".part")
+}
+
+func (s *UploadStore) statePath(id string) string {
+	return filepath.Join(s.Dir, id+".json")
+}
+
+func (s *UploadStore) load(id string) (*ResumableUpload, error) {
+	uploadBytes, err := os.ReadFile(s.statePath(id))
+	if err != nil {
+		return nil, err
+	}
+
+	var upload ResumableUpload
+	if err := json.Unmarshal(uploadBytes, &upload); err != nil {
+		return nil, err
+	}
+	return &upload, nil
+}
+
+func (s *UploadStore) save(upload *ResumableUpload) error {
+	uploadBytes, err := json.Marshal(upload)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(s.statePath(upload.ID), uploadBytes, 0600)
+}
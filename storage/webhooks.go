@@ -0,0 +1,141 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WebhookDelivery is a completion callback sent to an API client together
+// with every attempt made to deliver it
+type WebhookDelivery struct {
+	ID        string           `json:"id"`
+	DemoID    string           `json:"demo_id"`
+	URL       string           `json:"url"`
+	Event     string           `json:"event"`
+	Secret    string           `json:"secret,omitempty"`   // HMAC key; never returned by the API
+	BaseURL   string           `json:"base_url,omitempty"` // Public URL of the server, used to rebuild download links on replay
+	Payload   json.RawMessage  `json:"payload"`
+	Status    string           `json:"status"` // "pending", "delivered" or "failed"
+	Attempts  []WebhookAttempt `json:"attempts"`
+	CreatedAt time.Time        `json:"created_at"`
+	UpdatedAt time.Time        `json:"updated_at"`
+}
+
+// WebhookAttempt is the outcome of a single POST of a webhook delivery
+type WebhookAttempt struct {
+	Time       time.Time `json:"time"`
+	StatusCode int       `json:"status_code,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	DurationMs int64     `json:"duration_ms"`
+}
+
+// WebhookStore persists webhook deliveries as JSON files. It must not live in
+// the publicly served output directory since deliveries contain secrets.
+type WebhookStore struct {
+	Dir string
+	mu  sync.Mutex
+}
+
+// NewWebhookStore creates a webhook store in dir, creating it if needed
+func NewWebhookStore(dir string) (*WebhookStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &WebhookStore{Dir: dir}, nil
+}
+
+// Save writes a delivery, replacing any earlier version
+func (s *WebhookStore) Save(delivery *WebhookDelivery) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delivery.UpdatedAt = time.Now()
+	deliveryBytes, err := json.Marshal(delivery)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(s.path(delivery.ID), deliveryBytes, 0600)
+}
+
+// Load reads a delivery by ID
+func (s *WebhookStore) Load(id string) (*WebhookDelivery, error) {
+	if id == "" || strings.ContainsAny(id, `/\.`) {
+		return nil, fmt.Errorf("invalid delivery ID %q", id)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	deliveryBytes, err := os.ReadFile(s.path(id))
+	if err != nil {
+		return nil, err
+	}
+
+	var delivery WebhookDelivery
+	if err := json.Unmarshal(deliveryBytes, &delivery); err != nil {
+		return nil, err
+	}
+
+	return &delivery, nil
+}
+
+// List returns deliveries, newest first, optionally only those for one demo
+// or with one status
+func (s *WebhookStore) List(demoID, status string) ([]WebhookDelivery, error) {
+	files, err := os.ReadDir(s.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var deliveries []WebhookDelivery
+	for _, file := range files {
+		id, found := strings.CutSuffix(file.Name(), ".json")
+		if file.IsDir() || !found {
+			continue
+		}
+
+		delivery, err := s.Load(id)
+		if err != nil {
+			continue
+		}
+		if (demoID != "" && delivery.DemoID != demoID) || (status != "" && delivery.Status != status) {
+			continue
+		}
+		deliveries = append(deliveries, *delivery)
+	}
+
+	sort.Slice(deliveries, func(i, j int) bool {
+		return deliveries[i].CreatedAt.After(deliveries[j].CreatedAt)
+	})
+
+	return deliveries, nil
+}
+
+// Prune deletes deliveries last updated more than maxAge ago
+func (s *WebhookStore) Prune(maxAge time.Duration) error {
+	deliveries, err := s.List("", "")
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, delivery := range deliveries {
+		if time.Since(delivery.UpdatedAt) > maxAge {
+			os.Remove(s.path(delivery.ID))
+		}
+	}
+	return nil
+}
+
+func (s *WebhookStore) path(id string) string {
+	return filepath.Join(s.Dir, id+".json")
+}
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"demovoice/storage"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	webhookMaxAttempts    = 6
+	webhookInitialBackoff = 5 * time.Second
+	webhookMaxBackoff     = 5 * time.Minute
+	webhookTimeout        = 15 * time.Second
+	webhookRetention      = 7 * 24 * time.Hour // How long delivery records are kept
+)
+
+// webhookClient only connects to public addresses, so callbacks can't be
+// used to reach services on the server's network, even through DNS or redirects
+var webhookClient = &http.Client{
+	Timeout: webhookTimeout,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{Timeout: webhookTimeout, Control: dialPublicOnly}).DialContext,
+	},
+}
+
+var (
+	waitingCallbacks      = make(map[string][]*webhookTarget) // Callbacks of requests that reused an unfinished demo
+	waitingCallbacksMutex sync.Mutex
+)
+
+// webhookTarget is where and how an API client wants to be told that a demo
+// has finished processing
+type webhookTarget struct {
+	URL     string
+	Secret  string
+	BaseURL string // Public URL of this server, used to build download links
+}
+
+// webhookPayload is the JSON body POSTed to a callback URL
+type webhookPayload struct {
+	Event      string                   `json:"event"` // "demo.completed" or "demo.failed"
+	DemoID     string                   `json:"demo_id"`
+	Status     string                   `json:"status"`
+	Error      *storage.ProcessingError `json:"error,omitempty"`
+	AudioURLs  map[string]string        `json:"audio_urls,omitempty"` // SteamID64 -> download URL
+	ChatLogURL string                   `json:"chat_log_url,omitempty"`
+	Metadata   *storage.DemoMetadata    `json:"metadata"`
+	Timestamp  time.Time                `json:"timestamp"`
+}
+
+// WebhookList is the response of GET /api/webhooks
+type WebhookList struct {
+	Deliveries []storage.WebhookDelivery `json:"deliveries"`
+}
+
+// webhookTargetFromRequest reads the optional callback_url and
+// callback_secret upload parameters
+func webhookTargetFromRequest(r *http.Request) (*webhookTarget, error) {
+	callbackURL := r.FormValue("callback_url")
+	if callbackURL == "" {
+		return nil, nil
+	}
+
+	parsed, err := url.Parse(callbackURL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return nil, fmt.Errorf("invalid callback_url %q: must be an absolute http(s) URL", callbackURL)
+	}
+	host := strings.ToLower(parsed.Hostname())
+	if ip := net.ParseIP(host); (ip != nil && !publicIP(ip)) || host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return nil, fmt.Errorf("invalid callback_url %q: must not point to a loopback or private address", callbackURL)
+	}
+
+	return &webhookTarget{
+		URL:     callbackURL,
+		Secret:  r.FormValue("callback_secret"),
+		BaseURL: publicBaseURL(r),
+	}, nil
+}
+
+// publicIP reports whether an address is reachable on the internet rather
+// than loopback, private, link-local or unspecified
+func publicIP(ip net.IP) bool {
+	return !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsLinkLocalUnicast() &&
+		!ip.IsLinkLocalMulticast() && !ip.IsMulticast() && !ip.IsUnspecified()
+}
+
+// dialPublicOnly refuses connections to non-public addresses once a callback
+// host has been resolved
+func dialPublicOnly(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !publicIP(ip) {
+		return fmt.Errorf("callback address %s is not public", host)
+	}
+	return nil
+}
+
+// publicBaseURL returns the URL clients reach this server at, from PUBLIC_URL
+// or the request
+func publicBaseURL(r *http.Request) string {
+	if publicURL := os.Getenv("PUBLIC_URL"); publicURL != "" {
+		return strings.TrimRight(publicURL, "/")
+	}
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+		scheme = proto
+	}
+	return scheme + "://" + r.Host
+}
+
+// newWebhookPayload describes how a demo finished, with download links that
+// are valid from now on
+func newWebhookPayload(baseURL, demoID string, metadata *storage.DemoMetadata, processErr error) webhookPayload {
+	payload := webhookPayload{
+		Event:     "demo.completed",
+		DemoID:    demoID,
+		Status:    "completed",
+		Metadata:  metadata,
+		Timestamp: time.Now().UTC(),
+	}
+	if processErr != nil {
+		payload.Event = "demo.failed"
+		payload.Status = "failed"
+		payload.Error = processingError(processErr)
+	}
+
+	if metadata != nil && processErr == nil {
+		payload.AudioURLs = make(map[string]string, len(metadata.Players))
+		for _, player := range metadata.Players {
+			payload.AudioURLs[player.SteamID] = baseURL + signedOutputURL(player.AudioFile)
+		}
+		if metadata.ChatLogJSON != "" {
+			payload.ChatLogURL = baseURL + signedOutputURL(metadata.ChatLogJSON)
+		}
+	}
+	return payload
+}
+
+// notifyWebhook records a completion callback for a demo and delivers it in
+// the background
+func notifyWebhook(target *webhookTarget, demoID string, metadata *storage.DemoMetadata, processErr error) {
+	payload := newWebhookPayload(target.BaseURL, demoID, metadata, processErr)
+	payloadBytes, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("Error encoding webhook for demo %s: %v", demoID, err)
+		return
+	}
+
+	delivery := &storage.WebhookDelivery{
+		ID:        fmt.Sprintf("wh_%d", time.Now().UnixNano()),
+		DemoID:    demoID,
+		URL:       target.URL,
+		Event:     payload.Event,
+		Secret:    target.Secret,
+		BaseURL:   target.BaseURL,
+		Payload:   payloadBytes,
+		Status:    "pending",
+		CreatedAt: time.Now(),
+	}
+	if err := webhookStore.Save(delivery); err != nil {
+		log.Printf("Warning: Failed to record webhook %s: %v", delivery.ID, err)
+	}
+
+	go deliverWebhook(delivery)
+}
+
+// notifyWhenFinished delivers a callback for an existing demo that a request
+// reused: right away when the demo has completed or failed, otherwise once it
+// finishes
+func notifyWhenFinished(target *webhookTarget, metadata *storage.DemoMetadata) {
+	waitingCallbacksMutex.Lock()
+	// Reload under the lock so a demo finishing meanwhile can't be missed
+	if current, err := metadataStore.LoadMetadata(metadata.DemoID); err == nil {
+		metadata = current
+	}
+	if demoInProgress(metadata) {
+		waitingCallbacks[metadata.DemoID] = append(waitingCallbacks[metadata.DemoID], target)
+		waitingCallbacksMutex.Unlock()
+		return
+	}
+	waitingCallbacksMutex.Unlock()
+
+	notifyWebhook(target, metadata.DemoID, metadata, demoError(metadata))
+}
+
+// notifyWaitingCallbacks delivers the callbacks waiting for a demo. It must
+// be called after the demo's final status is saved.
+func notifyWaitingCallbacks(demoID string, metadata *storage.DemoMetadata, processErr error) {
+	waitingCallbacksMutex.Lock()
+	targets := waitingCallbacks[demoID]
+	delete(waitingCallbacks, demoID)
+	waitingCallbacksMutex.Unlock()
+
+	for _, target := range targets {
+		notifyWebhook(target, demoID, metadata, processErr)
+	}
+}
+
+// deliverWebhook POSTs a delivery until the receiver answers with a 2xx
+// status, backing off exponentially between attempts
+func deliverWebhook(delivery *storage.WebhookDelivery) {
+	backoff := webhookInitialBackoff
+	for attempt := 1; attempt <= webhookMaxAttempts; attempt++ {
+		result := postWebhook(delivery)
+		delivery.Attempts = append(delivery.Attempts, result)
+
+		if result.Error == "" {
+			delivery.Status = "delivered"
+		} else if attempt == webhookMaxAttempts {
+			delivery.Status = "failed"
+		}
+		if err := webhookStore.Save(delivery); err != nil {
+			log.Printf("Warning: Failed to record webhook %s: %v", delivery.ID, err)
+		}
+
+		if delivery.Status == "delivered" {
+			log.Printf("📨 Webhook %s for demo %s delivered to %s", delivery.ID, delivery.DemoID, delivery.URL)
+			return
+		}
+
+		log.Printf("Warning: Webhook %s attempt %d/%d failed: %s", delivery.ID, attempt, webhookMaxAttempts, result.Error)
+		if attempt < webhookMaxAttempts {
+			time.Sleep(backoff)
+			backoff = min(backoff*2, webhookMaxBackoff)
+		}
+	}
+}
+
+func postWebhook(delivery *storage.WebhookDelivery) storage.WebhookAttempt {
+	start := time.Now()
+	result := storage.WebhookAttempt{Time: start}
+
+	req, err := http.NewRequest(http.MethodPost, delivery.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	timestamp := strconv.FormatInt(start.Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "demovoice-webhook/1.0")
+	req.Header.Set("X-Demovoice-Event", delivery.Event)
+	req.Header.Set("X-Demovoice-Delivery", delivery.ID)
+	req.Header.Set("X-Demovoice-Timestamp", timestamp)
+	if delivery.Secret != "" {
+		req.Header.Set("X-Demovoice-Signature", "sha256="+signWebhook(delivery.Secret, timestamp, delivery.Payload))
+	}
+
+	resp, err := webhookClient.Do(req)
+	result.DurationMs = time.Since(start).Milliseconds()
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	resp.Body.Close()
+
+	result.StatusCode = resp.StatusCode
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		result.Error = fmt.Sprintf("unexpected status %s", resp.Status)
+	}
+	return result
+}
+
+// signWebhook returns the hex HMAC-SHA256 of "<timestamp>.<body>". Receivers
+// should recompute it and reject old timestamps to prevent replays.
+func signWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// startWebhookCleanup periodically removes old delivery records
+func startWebhookCleanup() {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := webhookStore.Prune(webhookRetention); err != nil {
+			log.Printf("Warning: Failed to prune webhook deliveries: %v", err)
+		}
+	}
+}
+
+// handleWebhooks lists webhook deliveries (?demo_id=, ?status=failed)
+func handleWebhooks(w http.ResponseWriter, r *http.Request) {
+	if _, ok := authorizeAPIRequest(w, r, storage.ScopeAdmin); !ok {
+		return
+	}
+
+	deliveries, err := webhookStore.List(r.URL.Query().Get("demo_id"), r.URL.Query().Get("status"))
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "Failed to list webhook deliveries")
+		return
+	}
+
+	for i := range deliveries {
+		deliveries[i].Secret = ""
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(WebhookList{Deliveries: deliveries})
+}
+
+// handleWebhook returns a single webhook delivery with its attempts
+func handleWebhook(w http.ResponseWriter, r *http.Request) {
+	if _, ok := authorizeAPIRequest(w, r, storage.ScopeAdmin); !ok {
+		return
+	}
+
+	delivery, err := webhookStore.Load(r.PathValue("id"))
+	if err != nil {
+		writeJSONError(w, http.StatusNotFound, "Webhook delivery not found")
+		return
+	}
+	delivery.Secret = ""
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(delivery)
+}
+
+// handleWebhookReplay sends a recorded delivery again with a fresh signature.
+// The payload is rebuilt from the demo's current metadata, so its download
+// links are valid again; it is resent as recorded once the demo has expired.
+func handleWebhookReplay(w http.ResponseWriter, r *http.Request) {
+	if _, ok := authorizeAPIRequest(w, r, storage.ScopeAdmin); !ok {
+		return
+	}
+
+	delivery, err := webhookStore.Load(r.PathValue("id"))
+	if err != nil {
+		writeJSONError(w, http.StatusNotFound, "Webhook delivery not found")
+		return
+	}
+	if delivery.Status == "pending" {
+		writeJSONError(w, http.StatusConflict, "Webhook delivery is still in progress")
+		return
+	}
+
+	if metadata, err := metadataStore.LoadMetadata(delivery.DemoID); err == nil {
+		if demoInProgress(metadata) {
+			writeJSONError(w, http.StatusConflict, "Demo is being processed again")
+			return
+		}
+
+		baseURL := delivery.BaseURL
+		if baseURL == "" {
+			baseURL = publicBaseURL(r)
+		}
+		payload := newWebhookPayload(baseURL, delivery.DemoID, metadata, demoError(metadata))
+		payloadBytes, err := json.Marshal(payload)
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, "Failed to encode webhook payload")
+			return
+		}
+		delivery.Event = payload.Event
+		delivery.Payload = payloadBytes
+	}
+
+	delivery.Status = "pending"
+	if err := webhookStore.Save(delivery); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "Failed to update webhook delivery")
+		return
+	}
+	log.Printf("Replaying webhook %s for demo %s", delivery.ID, delivery.DemoID)
+	go deliverWebhook(delivery)
+
+	response := *delivery
+	response.Secret = ""
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(response)
+}
+
+// writeJSONError writes an error in the same shape as APIUploadResponse
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(APIUploadResponse{Success: false, Error: message})
+}